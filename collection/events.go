@@ -0,0 +1,341 @@
+package collection
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var ErrVetoed = errors.New("change vetoed")
+
+type EventType int
+
+const (
+	EventCreated EventType = iota
+	EventUpdated
+	EventDeleted
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventCreated:
+		return "created"
+	case EventUpdated:
+		return "updated"
+	case EventDeleted:
+		return "deleted"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+func (t EventType) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+func (t *EventType) UnmarshalText(text []byte) error {
+	for _, candidate := range []EventType{EventCreated, EventUpdated, EventDeleted} {
+		if candidate.String() == string(text) {
+			*t = candidate
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown event type %q", text)
+}
+
+// Event describes one committed (or, for BeforeCommit hooks, proposed)
+// change. Before is a copy of the stored item and is zero for EventCreated;
+// After is zero for EventDeleted.
+type Event[T any] struct {
+	Type   EventType
+	Key    string
+	Before T
+	After  T
+	Time   time.Time
+}
+
+// SlowConsumerPolicy decides what happens when a subscriber's buffer is full
+type SlowConsumerPolicy int
+
+const (
+	// DropNewest discards the event that does not fit
+	DropNewest SlowConsumerPolicy = iota
+	// DropOldest discards the oldest buffered event to make room
+	DropOldest
+	// Block waits for the subscriber, holding up every later change
+	Block
+)
+
+// Subscription receives events on C until Close is called
+type Subscription[T any] struct {
+	C <-chan Event[T]
+
+	ch      chan Event[T]
+	policy  SlowConsumerPolicy
+	dropped atomic.Uint64
+	done    chan struct{}
+	once    sync.Once
+	cancel  func()
+
+	// mu keeps send from racing with closing ch
+	mu     sync.RWMutex
+	closed bool
+}
+
+// Dropped returns how many events were discarded because the subscriber
+// fell behind
+func (s *Subscription[T]) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+// Close stops the subscription and closes C
+func (s *Subscription[T]) Close() {
+	s.once.Do(func() {
+		close(s.done)
+		s.cancel()
+
+		s.mu.Lock()
+		s.closed = true
+		close(s.ch)
+		s.mu.Unlock()
+	})
+}
+
+func (s *Subscription[T]) send(event Event[T]) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return
+	}
+
+	switch s.policy {
+	case Block:
+		select {
+		case s.ch <- event:
+		case <-s.done:
+		}
+	case DropOldest:
+		for {
+			select {
+			case s.ch <- event:
+				return
+			default:
+			}
+			select {
+			case <-s.ch:
+				s.dropped.Add(1)
+			default:
+			}
+		}
+	default:
+		select {
+		case s.ch <- event:
+		default:
+			s.dropped.Add(1)
+		}
+	}
+}
+
+// events holds the listeners of a Manager, guarded by its mu
+type events[T any] struct {
+	hooks         []func(Event[T])
+	subscriptions []*Subscription[T]
+	beforeCommit  []func(Event[T]) error
+
+	// staged are internal hooks that may veto a change like beforeCommit
+	// and take part in the commit with the step they return
+	staged []func(Event[T]) (commitStep, error)
+
+	// Committed events wait in pending until the goroutine that is
+	// dispatching delivers them, which keeps them in commit order
+	pending     []Event[T]
+	dispatching bool
+
+	// snapshots holds copies of the stored items once anyone listens, since
+	// callers usually modify the registered item in place before Update
+	snapshots map[string]T
+}
+
+// OnEvent calls fn after every committed change, in commit order. fn runs
+// synchronously and may use the Manager.
+func (manager *Manager[T, ID]) OnEvent(fn func(Event[T])) {
+	manager.listen()
+	manager.mu.Lock()
+	manager.events.hooks = append(manager.events.hooks, fn)
+	manager.mu.Unlock()
+}
+
+// BeforeCommit calls fn for every change before it is written. An error
+// cancels the whole commit. fn runs while the Manager is locked and must not
+// change it.
+func (manager *Manager[T, ID]) BeforeCommit(fn func(Event[T]) error) {
+	manager.listen()
+	manager.mu.Lock()
+	manager.events.beforeCommit = append(manager.events.beforeCommit, fn)
+	manager.mu.Unlock()
+}
+
+// Subscribe delivers events on a channel with the given buffer. The policy
+// decides what happens when the subscriber does not keep up.
+func (manager *Manager[T, ID]) Subscribe(buffer int, policy SlowConsumerPolicy) *Subscription[T] {
+	manager.listen()
+
+	ch := make(chan Event[T], buffer)
+	sub := &Subscription[T]{C: ch, ch: ch, policy: policy, done: make(chan struct{})}
+	sub.cancel = func() {
+		manager.mu.Lock()
+		defer manager.mu.Unlock()
+		manager.events.subscriptions = slices.DeleteFunc(manager.events.subscriptions, func(s *Subscription[T]) bool {
+			return s == sub
+		})
+	}
+
+	manager.mu.Lock()
+	manager.events.subscriptions = append(manager.events.subscriptions, sub)
+	manager.mu.Unlock()
+	return sub
+}
+
+// listen starts keeping snapshots of the stored items
+func (manager *Manager[T, ID]) listen() {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	if manager.events.snapshots != nil {
+		return
+	}
+	manager.events.snapshots = make(map[string]T)
+	for _, item := range manager.items.GetAllValues() {
+		manager.remember(keyOf(item.GetID()), item)
+	}
+}
+
+// remember must be called with mu held
+func (manager *Manager[T, ID]) remember(key string, item T) {
+	if manager.events.snapshots == nil {
+		return
+	}
+	data, err := json.Marshal(item)
+	var snapshot T
+	if err == nil {
+		err = json.Unmarshal(data, &snapshot)
+	}
+	if err != nil {
+		log.Printf("collection: copying item %s for events: %v", key, err)
+		snapshot = item
+	}
+	manager.events.snapshots[key] = snapshot
+}
+
+// forget must be called with mu held
+func (manager *Manager[T, ID]) forget(key string) {
+	if manager.events.snapshots != nil {
+		delete(manager.events.snapshots, key)
+	}
+}
+
+// newEvent must be called with mu held
+func (manager *Manager[T, ID]) newEvent(eventType EventType, key string, after T) Event[T] {
+	return Event[T]{
+		Type:   eventType,
+		Key:    key,
+		Before: manager.events.snapshots[key],
+		After:  after,
+		Time:   time.Now(),
+	}
+}
+
+// changeEvents describes the changes of a commit, or returns nil when
+// nobody listens. Must be called with mu held.
+func (manager *Manager[T, ID]) changeEvents(changes []itemChange[T]) []Event[T] {
+	if manager.events.snapshots == nil {
+		return nil
+	}
+
+	var events []Event[T]
+	exists := func(key string) bool {
+		_, ok := manager.versions[key]
+		return ok
+	}
+	for _, change := range changes {
+		switch {
+		case change.kind == changeDelete:
+			if exists(change.key) {
+				events = append(events, manager.newEvent(EventDeleted, change.key, *new(T)))
+			}
+		case exists(change.key):
+			events = append(events, manager.newEvent(EventUpdated, change.key, change.item))
+		default:
+			events = append(events, manager.newEvent(EventCreated, change.key, change.item))
+		}
+	}
+	return events
+}
+
+// stage registers an internal hook that takes part in every commit
+func (manager *Manager[T, ID]) stage(fn func(Event[T]) (commitStep, error)) {
+	manager.listen()
+	manager.mu.Lock()
+	manager.events.staged = append(manager.events.staged, fn)
+	manager.mu.Unlock()
+}
+
+// vetoed runs the BeforeCommit and staged hooks and returns the steps of the
+// staged ones. Must be called with mu held.
+func (manager *Manager[T, ID]) vetoed(events []Event[T]) (commitSteps, error) {
+	var steps commitSteps
+	for _, event := range events {
+		for _, hook := range manager.events.beforeCommit {
+			if err := hook(event); err != nil {
+				steps.finish()
+				return nil, fmt.Errorf("%w: %w", ErrVetoed, err)
+			}
+		}
+		for _, hook := range manager.events.staged {
+			step, err := hook(event)
+			if err != nil {
+				steps.finish()
+				return nil, fmt.Errorf("%w: %w", ErrVetoed, err)
+			}
+			steps = append(steps, step)
+		}
+	}
+	return steps, nil
+}
+
+// publish queues the events and releases mu. Unless another goroutine is
+// already dispatching, it then delivers the queue to hooks and subscribers.
+// Must be called with mu held.
+func (manager *Manager[T, ID]) publish(events []Event[T]) {
+	manager.events.pending = append(manager.events.pending, events...)
+	if manager.events.dispatching || len(manager.events.pending) == 0 {
+		manager.mu.Unlock()
+		return
+	}
+
+	manager.events.dispatching = true
+	for len(manager.events.pending) > 0 {
+		batch := manager.events.pending
+		manager.events.pending = nil
+		hooks := slices.Clone(manager.events.hooks)
+		subscriptions := slices.Clone(manager.events.subscriptions)
+		manager.mu.Unlock()
+
+		for _, event := range batch {
+			for _, hook := range hooks {
+				hook(event)
+			}
+			for _, sub := range subscriptions {
+				sub.send(event)
+			}
+		}
+
+		manager.mu.Lock()
+	}
+	manager.events.dispatching = false
+	manager.mu.Unlock()
+}
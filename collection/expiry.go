@@ -0,0 +1,85 @@
+package collection
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+)
+
+var ErrExpiryDisabled = errors.New("item expiry is not set")
+
+// DefaultSweepInterval is how often StartExpirySweeper deletes expired
+// items when no interval is given
+var DefaultSweepInterval = time.Minute
+
+type expiryFunc[T any] func(T) time.Time
+
+// SetExpiry makes items expire at the time expiresAt returns; a zero time
+// never expires. Expired items are hidden from reads right away and
+// deleted by SweepExpired.
+func (manager *Manager[T, ID]) SetExpiry(expiresAt func(T) time.Time) {
+	if expiresAt == nil {
+		manager.expiry.Store(nil)
+		return
+	}
+	fn := expiryFunc[T](expiresAt)
+	manager.expiry.Store(&fn)
+}
+
+func (manager *Manager[T, ID]) expired(item T, now time.Time) bool {
+	fn := manager.expiry.Load()
+	if fn == nil {
+		return false
+	}
+	at := (*fn)(item)
+	return !at.IsZero() && !now.Before(at)
+}
+
+// SweepExpired deletes the expired items in one commit, which publishes an
+// EventDeleted for each (and moves them to the trash when enabled). It
+// returns how many were deleted.
+func (manager *Manager[T, ID]) SweepExpired() (int, error) {
+	if manager.expiry.Load() == nil {
+		return 0, nil
+	}
+
+	// Collected under the lock so an item updated meanwhile is not deleted
+	return manager.commitBuilt(func() ([]itemChange[T], error) {
+		now := time.Now()
+		var changes []itemChange[T]
+		for _, item := range manager.items.GetAllValues() {
+			if manager.expired(item, now) {
+				changes = append(changes, itemChange[T]{kind: changeDelete, key: keyOf(item.GetID())})
+			}
+		}
+		return changes, nil
+	})
+}
+
+// StartExpirySweeper calls SweepExpired every interval (DefaultSweepInterval
+// when zero) in the background until ctx is done
+func (manager *Manager[T, ID]) StartExpirySweeper(ctx context.Context, interval time.Duration) error {
+	if manager.expiry.Load() == nil {
+		return ErrExpiryDisabled
+	}
+	if interval <= 0 {
+		interval = DefaultSweepInterval
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if _, err := manager.SweepExpired(); err != nil {
+				log.Printf("collection: deleting expired items: %v", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
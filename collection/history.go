@@ -0,0 +1,378 @@
+package collection
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mahdi-cpp/api-go-pkg/metadata"
+)
+
+// HistoryExtension is the extension of the per-item history files of
+// directory collections
+const HistoryExtension = ".history"
+
+var ErrHistoryDisabled = errors.New("history is not enabled")
+
+// Revision is the state of an item after a change. Deleted revisions hold
+// the item as it was when deleted.
+type Revision[T any] struct {
+	Rev   int       `json:"rev"`
+	Type  EventType `json:"type"`
+	Time  time.Time `json:"time"`
+	Actor string    `json:"actor,omitempty"`
+	Item  T         `json:"item"`
+}
+
+type historyLine[T any] struct {
+	Key string `json:"key"`
+	Revision[T]
+}
+
+// history keeps revisions as JSON lines, either in one file per item or in
+// one shared log. Lines are sealed like the collection when it is
+// encrypted. Files are trimmed to the last limit revisions per item once
+// they hold twice as many.
+type history[T any] struct {
+	limit   int
+	fileOf  func(key string) string
+	options []metadata.Option
+
+	mu    sync.Mutex
+	files map[string]*historyFile
+}
+
+type historyFile struct {
+	lines int
+	last  map[string]int // last revision per key
+}
+
+func newHistory[T any](limit int, fileOf func(key string) string, options []metadata.Option) *history[T] {
+	return &history[T]{limit: limit, fileOf: fileOf, options: options, files: make(map[string]*historyFile)}
+}
+
+// read returns the lines of a history file. Damaged lines, such as a torn
+// last line left by a crash, are skipped; a wrong key is an error.
+func (h *history[T]) read(path string) ([]historyLine[T], error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var lines []historyLine[T]
+	reader := bufio.NewReader(file)
+	for {
+		data, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(data) > 0 {
+				log.Printf("collection: skipping torn history line at the end of %s", path)
+			}
+			return lines, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		data, err = metadata.OpenValue(bytes.TrimSuffix(data, []byte("\n")), h.options...)
+		if errors.Is(err, metadata.ErrWrongKey) || errors.Is(err, metadata.ErrNoKeyProvider) {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		var line historyLine[T]
+		if err != nil || json.Unmarshal(data, &line) != nil {
+			log.Printf("collection: skipping damaged history line in %s", path)
+			continue
+		}
+		lines = append(lines, line)
+	}
+}
+
+// file returns the counters of a history file, reading it on first use.
+// Must be called with mu held.
+func (h *history[T]) file(path string) (*historyFile, error) {
+	if f, ok := h.files[path]; ok {
+		return f, nil
+	}
+	lines, err := h.read(path)
+	if err != nil {
+		return nil, err
+	}
+	f := &historyFile{lines: len(lines), last: make(map[string]int)}
+	for _, line := range lines {
+		f.last[line.Key] = max(f.last[line.Key], line.Rev)
+	}
+	h.files[path] = f
+	return f, nil
+}
+
+func (h *history[T]) list(key string) ([]Revision[T], error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	lines, err := h.read(h.fileOf(key))
+	if err != nil {
+		return nil, err
+	}
+	var revisions []Revision[T]
+	for _, line := range lines {
+		if line.Key == key {
+			revisions = append(revisions, line.Revision)
+		}
+	}
+	if h.limit > 0 && len(revisions) > h.limit {
+		revisions = revisions[len(revisions)-h.limit:]
+	}
+	return revisions, nil
+}
+
+// record appends a revision per change, numbering them per item
+func (h *history[T]) record(changes []historyLine[T]) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	byFile := make(map[string][]byte)
+	var order []string
+	for _, change := range changes {
+		path := h.fileOf(change.Key)
+		f, err := h.file(path)
+		if err != nil {
+			return err
+		}
+		f.last[change.Key]++
+		f.lines++
+		change.Rev = f.last[change.Key]
+
+		data, err := h.encode(change)
+		if err != nil {
+			return err
+		}
+		if _, ok := byFile[path]; !ok {
+			order = append(order, path)
+		}
+		byFile[path] = append(append(byFile[path], data...), '\n')
+	}
+
+	for _, path := range order {
+		if err := appendFile(path, byFile[path]); err != nil {
+			delete(h.files, path) // recount on next use
+			return err
+		}
+		if f := h.files[path]; h.limit > 0 && f.lines > 2*h.limit*len(f.last) {
+			if err := h.trim(path); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (h *history[T]) encode(line historyLine[T]) ([]byte, error) {
+	data, err := json.Marshal(line)
+	if err != nil {
+		return nil, err
+	}
+	return metadata.SealValue(data, h.options...)
+}
+
+// appendFile appends complete lines to path. A torn last line left by a
+// crash is cut off first, so the new lines do not continue it. Must be
+// called with mu held.
+func appendFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	end, err := completeLines(file)
+	if err == nil {
+		err = file.Truncate(end)
+	}
+	if err == nil {
+		_, err = file.WriteAt(data, end)
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// completeLines returns the length of the file up to its last newline
+func completeLines(file *os.File) (int64, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 4096)
+	for end := info.Size(); end > 0; {
+		start := max(end-int64(len(buf)), 0)
+		chunk := buf[:end-start]
+		if _, err := file.ReadAt(chunk, start); err != nil {
+			return 0, err
+		}
+		if i := bytes.LastIndexByte(chunk, '\n'); i >= 0 {
+			return start + int64(i) + 1, nil
+		}
+		end = start
+	}
+	return 0, nil
+}
+
+// trim rewrites a history file with the last limit revisions of each item.
+// Must be called with mu held.
+func (h *history[T]) trim(path string) error {
+	lines, err := h.read(path)
+	if err != nil {
+		return err
+	}
+
+	total := make(map[string]int)
+	for _, line := range lines {
+		total[line.Key]++
+	}
+	var buf bytes.Buffer
+	seen := make(map[string]int)
+	for _, line := range lines {
+		seen[line.Key]++
+		if total[line.Key]-seen[line.Key] >= h.limit {
+			continue
+		}
+		data, err := h.encode(line)
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+
+	tempFile := path + ".tmp"
+	if err := os.WriteFile(tempFile, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tempFile, path); err != nil {
+		return err
+	}
+	delete(h.files, path)
+	return nil
+}
+
+// newManagerHistory keeps per-item files for directory collections and a
+// shared <name>.history.jsonl log otherwise
+func newManagerHistory[T Item[ID], ID comparable](path string, cfg config, store storage[T, ID]) *history[T] {
+	if dir, ok := store.(*directoryStorage[T, ID]); ok {
+		return newHistory[T](cfg.historyLimit, func(key string) string {
+			return strings.TrimSuffix(dir.itemPath(key), dir.ext) + HistoryExtension
+		}, cfg.metadata)
+	}
+	logPath := sidecarPath(path, cfg, "history", ".jsonl")
+	return newHistory[T](cfg.historyLimit, func(string) string { return logPath }, cfg.metadata)
+}
+
+// recordHistory appends the revisions of a commit. The changes are already
+// stored, so a failure is only logged. Must be called with mu held, before
+// the registry is updated.
+func (manager *Manager[T, ID]) recordHistory(changes []itemChange[T]) {
+	if manager.history == nil {
+		return
+	}
+
+	now := time.Now()
+	lines := make([]historyLine[T], 0, len(changes))
+	for _, change := range changes {
+		line := historyLine[T]{Key: change.key, Revision: Revision[T]{Time: now, Actor: change.actor, Item: change.item}}
+		switch {
+		case change.kind == changeDelete:
+			previous, err := manager.items.Get(change.key)
+			if err != nil {
+				continue
+			}
+			line.Type, line.Item = EventDeleted, previous
+		case change.kind == changeCreate:
+			line.Type = EventCreated
+		default:
+			line.Type = EventUpdated
+		}
+		lines = append(lines, line)
+	}
+	if err := manager.history.record(lines); err != nil {
+		log.Printf("collection: recording history: %v", err)
+	}
+}
+
+// History returns the kept revisions of an item, oldest first
+func (manager *Manager[T, ID]) History(id ID) ([]Revision[T], error) {
+	if manager.history == nil {
+		return nil, ErrHistoryDisabled
+	}
+	return manager.history.list(keyOf(id))
+}
+
+func (manager *Manager[T, ID]) revision(id ID, rev int) (Revision[T], error) {
+	revisions, err := manager.History(id)
+	if err != nil {
+		return Revision[T]{}, err
+	}
+	for _, revision := range revisions {
+		if revision.Rev == rev {
+			return revision, nil
+		}
+	}
+	return Revision[T]{}, fmt.Errorf("revision %d of %s: %w", rev, keyOf(id), ErrNotFound)
+}
+
+// DiffRevisions lists the fields that changed from revision a to b, named
+// by their json tags
+func (manager *Manager[T, ID]) DiffRevisions(id ID, a, b int) ([]metadata.Change, error) {
+	before, err := manager.revision(id, a)
+	if err != nil {
+		return nil, err
+	}
+	after, err := manager.revision(id, b)
+	if err != nil {
+		return nil, err
+	}
+	return metadata.DiffValues(before.Item, after.Item)
+}
+
+// Revert stores the item as it was in revision rev, which is recorded as a
+// new revision. A deleted item is created again.
+func (manager *Manager[T, ID]) Revert(id ID, rev int) (T, error) {
+	revision, err := manager.revision(id, rev)
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+
+	item := revision.Item
+	item.SetID(id)
+	key := keyOf(id)
+	// Decided under the lock; recreating a deleted item also takes it out
+	// of the trash
+	_, err = manager.commitBuilt(func() ([]itemChange[T], error) {
+		setModified(item, time.Now())
+		kind := changeUpdate
+		if _, live := manager.versions[key]; !live {
+			kind = changeCreate
+		}
+		return []itemChange[T]{{kind: kind, key: key, item: item}}, nil
+	})
+	return item, err
+}
@@ -0,0 +1,198 @@
+package collection
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/oklog/ulid/v2"
+
+	"github.com/mahdi-cpp/api-go-pkg/metadata"
+)
+
+// IDGenerator hands out the ids of new items
+type IDGenerator[ID comparable] interface {
+	// NextID returns a new unique id
+	NextID() (ID, error)
+	// Observe is called with the id of every item loaded from storage
+	Observe(id ID)
+}
+
+// batchIDGenerator is implemented by generators that allocate several ids
+// at once more cheaply than one by one
+type batchIDGenerator[ID comparable] interface {
+	NextIDs(n int) ([]ID, error)
+}
+
+// nextIDs returns n new ids
+func nextIDs[ID comparable](ids IDGenerator[ID], n int) ([]ID, error) {
+	if batch, ok := ids.(batchIDGenerator[ID]); ok {
+		return batch.NextIDs(n)
+	}
+	result := make([]ID, n)
+	for i := range result {
+		id, err := ids.NextID()
+		if err != nil {
+			return nil, err
+		}
+		result[i] = id
+	}
+	return result, nil
+}
+
+// SequentialIDs generates 1, 2, 3, ... continuing after the highest loaded id
+func SequentialIDs() IDGenerator[int] {
+	return &sequentialIDs{}
+}
+
+type sequentialIDs struct {
+	mu   sync.Mutex
+	last int
+}
+
+func (g *sequentialIDs) NextID() (int, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.last++
+	return g.last, nil
+}
+
+func (g *sequentialIDs) Observe(id int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if id > g.last {
+		g.last = id
+	}
+}
+
+// sequenceLockTimeout bounds the wait for another process allocating an id
+var sequenceLockTimeout = 10 * time.Second
+
+// PersistedSequentialIDs works like SequentialIDs but stores the highest id
+// handed out in a sequence file, so the ids of deleted items are never
+// reused. The file is locked while ids are allocated, which keeps
+// allocation atomic across processes too; a transaction allocates the ids
+// of all its new items with one update. With an empty path the file is
+// kept next to the collection as <name>.seq.json.
+func PersistedSequentialIDs(path string) IDGenerator[int] {
+	return &persistedIDs{path: path}
+}
+
+type sequence struct {
+	Last int `json:"last"`
+}
+
+type persistedIDs struct {
+	path string
+
+	mu       sync.Mutex
+	ctrl     *metadata.Control[sequence]
+	observed int
+}
+
+// bind is called by NewManager with the path of the collection
+func (g *persistedIDs) bind(collectionPath string, cfg config) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.path == "" {
+		g.path = sidecarPath(collectionPath, cfg, "seq", ".json")
+	}
+	g.ctrl = metadata.NewMetadataControl[sequence](g.path, metadata.WithFileLock(sequenceLockTimeout))
+}
+
+func (g *persistedIDs) NextID() (int, error) {
+	ids, err := g.NextIDs(1)
+	if err != nil {
+		return 0, err
+	}
+	return ids[0], nil
+}
+
+// NextIDs allocates n consecutive ids with a single update of the file
+func (g *persistedIDs) NextIDs(n int) ([]int, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.ctrl == nil {
+		if g.path == "" {
+			return nil, errors.New("sequence file is not set")
+		}
+		g.ctrl = metadata.NewMetadataControl[sequence](g.path, metadata.WithFileLock(sequenceLockTimeout))
+	}
+
+	var first int
+	err := g.ctrl.Update(func(s *sequence) error {
+		// Loaded items may predate the sequence file
+		first = max(s.Last, g.observed) + 1
+		s.Last = first + n - 1
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("allocating ids: %w", err)
+	}
+
+	ids := make([]int, n)
+	for i := range ids {
+		ids[i] = first + i
+	}
+	return ids, nil
+}
+
+func (g *persistedIDs) Observe(id int) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.observed = max(g.observed, id)
+}
+
+// UUIDv7IDs generates time-ordered UUIDv7 strings
+func UUIDv7IDs() IDGenerator[string] {
+	return uuidV7IDs{}
+}
+
+type uuidV7IDs struct{}
+
+func (uuidV7IDs) NextID() (string, error) {
+	u7, err := uuid.NewV7()
+	if err != nil {
+		return "", fmt.Errorf("error generating UUIDv7: %w", err)
+	}
+	return u7.String(), nil
+}
+
+func (uuidV7IDs) Observe(string) {}
+
+// ULIDs generates lexicographically sortable ULID strings, monotonic within
+// the same millisecond
+func ULIDs() IDGenerator[string] {
+	return &ulidIDs{entropy: ulid.Monotonic(rand.Reader, 0)}
+}
+
+type ulidIDs struct {
+	mu      sync.Mutex
+	entropy *ulid.MonotonicEntropy
+}
+
+func (g *ulidIDs) NextID() (string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	id, err := ulid.New(ulid.Now(), g.entropy)
+	if err != nil {
+		return "", fmt.Errorf("error generating ULID: %w", err)
+	}
+	return id.String(), nil
+}
+
+func (g *ulidIDs) Observe(string) {}
+
+// IDFunc uses a caller supplied function as generator
+func IDFunc[ID comparable](next func() (ID, error)) IDGenerator[ID] {
+	return idFunc[ID](next)
+}
+
+type idFunc[ID comparable] func() (ID, error)
+
+func (f idFunc[ID]) NextID() (ID, error) { return f() }
+func (f idFunc[ID]) Observe(ID)          {}
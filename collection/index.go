@@ -0,0 +1,331 @@
+package collection
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"time"
+)
+
+var (
+	ErrUnknownIndex     = errors.New("unknown index")
+	ErrUniqueViolation  = errors.New("unique index violation")
+	ErrIndexNotOrdered  = errors.New("index does not support range lookups")
+	ErrIndexKeyMismatch = errors.New("index key has the wrong type")
+)
+
+// Index is a secondary index on a Manager, created with NewIndex or
+// NewOrderedIndex and registered with Manager.AddIndex
+type Index[T any] interface {
+	reset()
+	add(key string, item T)
+	remove(key string)
+	saved(key string) any
+	restore(key string, saved any)
+	conflicts(key string, item T) bool
+	lookup(value any) ([]string, error)
+	lookupRange(from, to any) ([]string, error)
+}
+
+// HashIndex maps the values returned by its key function to items
+type HashIndex[T any, K comparable] struct {
+	keysOf  func(T) []K
+	unique  bool
+	entries map[K]map[string]struct{}
+	byItem  map[string][]K // keys each item was indexed under
+}
+
+// NewIndex indexes items under every value keysOf returns, e.g. the ChatID
+// of a message or the ids of the assets it references
+func NewIndex[T any, K comparable](keysOf func(T) []K) *HashIndex[T, K] {
+	index := &HashIndex[T, K]{keysOf: keysOf}
+	index.reset()
+	return index
+}
+
+// Unique rejects items whose keys are already used by another item
+func (i *HashIndex[T, K]) Unique() *HashIndex[T, K] {
+	i.unique = true
+	return i
+}
+
+func (i *HashIndex[T, K]) reset() {
+	i.entries = make(map[K]map[string]struct{})
+	i.byItem = make(map[string][]K)
+}
+
+func (i *HashIndex[T, K]) add(key string, item T) {
+	i.put(key, uniqueKeys(i.keysOf(item)))
+}
+
+func (i *HashIndex[T, K]) put(key string, keys []K) {
+	i.remove(key)
+	if len(keys) == 0 {
+		return
+	}
+	for _, k := range keys {
+		if i.entries[k] == nil {
+			i.entries[k] = make(map[string]struct{})
+		}
+		i.entries[k][key] = struct{}{}
+	}
+	i.byItem[key] = keys
+}
+
+func (i *HashIndex[T, K]) remove(key string) {
+	for _, k := range i.byItem[key] {
+		delete(i.entries[k], key)
+		if len(i.entries[k]) == 0 {
+			delete(i.entries, k)
+		}
+	}
+	delete(i.byItem, key)
+}
+
+// saved returns the keys an item is indexed under, for restore
+func (i *HashIndex[T, K]) saved(key string) any {
+	return i.byItem[key]
+}
+
+func (i *HashIndex[T, K]) restore(key string, saved any) {
+	keys, _ := saved.([]K)
+	i.put(key, keys)
+}
+
+func (i *HashIndex[T, K]) conflicts(key string, item T) bool {
+	if !i.unique {
+		return false
+	}
+	for _, k := range i.keysOf(item) {
+		for other := range i.entries[k] {
+			if other != key {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (i *HashIndex[T, K]) lookup(value any) ([]string, error) {
+	k, ok := value.(K)
+	if !ok {
+		var zero K
+		return nil, fmt.Errorf("%w: got %T, want %T", ErrIndexKeyMismatch, value, zero)
+	}
+	keys := make([]string, 0, len(i.entries[k]))
+	for key := range i.entries[k] {
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+func (i *HashIndex[T, K]) lookupRange(from, to any) ([]string, error) {
+	return nil, ErrIndexNotOrdered
+}
+
+// OrderedIndex is a HashIndex that also supports range lookups
+type OrderedIndex[T any, K cmp.Ordered] struct {
+	*HashIndex[T, K]
+	sorted []K
+}
+
+// NewOrderedIndex creates an index with range lookups, e.g. on dates or
+// UUIDv7 ids
+func NewOrderedIndex[T any, K cmp.Ordered](keysOf func(T) []K) *OrderedIndex[T, K] {
+	return &OrderedIndex[T, K]{HashIndex: NewIndex(keysOf)}
+}
+
+// Unique rejects items whose keys are already used by another item
+func (i *OrderedIndex[T, K]) Unique() *OrderedIndex[T, K] {
+	i.unique = true
+	return i
+}
+
+func (i *OrderedIndex[T, K]) reset() {
+	i.HashIndex.reset()
+	i.sorted = nil
+}
+
+func (i *OrderedIndex[T, K]) add(key string, item T) {
+	i.put(key, uniqueKeys(i.keysOf(item)))
+}
+
+func (i *OrderedIndex[T, K]) restore(key string, saved any) {
+	keys, _ := saved.([]K)
+	i.put(key, keys)
+}
+
+func (i *OrderedIndex[T, K]) put(key string, keys []K) {
+	i.remove(key)
+	i.HashIndex.put(key, keys)
+	for _, k := range i.byItem[key] {
+		if pos, found := slices.BinarySearch(i.sorted, k); !found {
+			i.sorted = slices.Insert(i.sorted, pos, k)
+		}
+	}
+}
+
+func (i *OrderedIndex[T, K]) remove(key string) {
+	keys := i.byItem[key]
+	i.HashIndex.remove(key)
+	for _, k := range keys {
+		if _, used := i.entries[k]; used {
+			continue
+		}
+		if pos, found := slices.BinarySearch(i.sorted, k); found {
+			i.sorted = slices.Delete(i.sorted, pos, pos+1)
+		}
+	}
+}
+
+// lookupRange returns the items with from <= key <= to, in key order
+func (i *OrderedIndex[T, K]) lookupRange(from, to any) ([]string, error) {
+	lo, ok := from.(K)
+	if !ok {
+		return nil, fmt.Errorf("%w: got %T, want %T", ErrIndexKeyMismatch, from, lo)
+	}
+	hi, ok := to.(K)
+	if !ok {
+		return nil, fmt.Errorf("%w: got %T, want %T", ErrIndexKeyMismatch, to, hi)
+	}
+
+	var keys []string
+	start, _ := slices.BinarySearch(i.sorted, lo)
+	for _, k := range i.sorted[start:] {
+		if k > hi {
+			break
+		}
+		group := make([]string, 0, len(i.entries[k]))
+		for key := range i.entries[k] {
+			group = append(group, key)
+		}
+		sort.Strings(group)
+		keys = append(keys, group...)
+	}
+	return keys, nil
+}
+
+func uniqueKeys[K comparable](keys []K) []K {
+	seen := make(map[K]bool, len(keys))
+	result := make([]K, 0, len(keys))
+	for _, k := range keys {
+		if !seen[k] {
+			seen[k] = true
+			result = append(result, k)
+		}
+	}
+	return result
+}
+
+// AddIndex registers an index and builds it from the loaded items
+func (manager *Manager[T, ID]) AddIndex(name string, index Index[T]) error {
+	manager.mu.Lock()
+	defer manager.mu.Unlock()
+
+	index.reset()
+	for _, item := range manager.items.GetAllValues() {
+		key := keyOf(item.GetID())
+		if index.conflicts(key, item) {
+			return fmt.Errorf("%w: %s: item %s", ErrUniqueViolation, name, key)
+		}
+		index.add(key, item)
+	}
+	manager.indexes[name] = index
+	return nil
+}
+
+// GetByIndex returns the items indexed under key
+func (manager *Manager[T, ID]) GetByIndex(name string, key any) ([]T, error) {
+	manager.mu.RLock()
+	defer manager.mu.RUnlock()
+
+	index, ok := manager.indexes[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownIndex, name)
+	}
+	keys, err := index.lookup(key)
+	if err != nil {
+		return nil, err
+	}
+	items := manager.itemsByKey(keys)
+	sort.Slice(items, func(i, j int) bool {
+		return compareIDs(items[i].GetID(), items[j].GetID()) < 0
+	})
+	return items, nil
+}
+
+// GetByRange returns the items of an ordered index with from <= key <= to,
+// in key order
+func (manager *Manager[T, ID]) GetByRange(name string, from, to any) ([]T, error) {
+	manager.mu.RLock()
+	defer manager.mu.RUnlock()
+
+	index, ok := manager.indexes[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownIndex, name)
+	}
+	keys, err := index.lookupRange(from, to)
+	if err != nil {
+		return nil, err
+	}
+	return manager.itemsByKey(keys), nil
+}
+
+func (manager *Manager[T, ID]) itemsByKey(keys []string) []T {
+	items := make([]T, 0, len(keys))
+	now := time.Now()
+	for _, key := range keys {
+		if item, err := manager.items.Get(key); err == nil && !manager.expired(item, now) {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// stageIndexes applies the changes to the indexes and enforces the unique
+// ones, returning a function that undoes them. Must be called with mu held.
+func (manager *Manager[T, ID]) stageIndexes(changes []itemChange[T]) (func(), error) {
+	type savedKeys struct {
+		index Index[T]
+		key   string
+		keys  any
+	}
+	var saved []savedKeys
+	undo := func() {
+		for i := len(saved) - 1; i >= 0; i-- {
+			saved[i].index.restore(saved[i].key, saved[i].keys)
+		}
+	}
+
+	for _, change := range changes {
+		for _, index := range manager.indexes {
+			saved = append(saved, savedKeys{index, change.key, index.saved(change.key)})
+			if change.kind == changeDelete {
+				index.remove(change.key)
+			} else {
+				index.add(change.key, change.item)
+			}
+		}
+	}
+
+	// Check once all changes are in, so a batch may move a unique key
+	// from one item to another
+	final := make(map[string]itemChange[T], len(changes))
+	for _, change := range changes {
+		final[change.key] = change
+	}
+	for _, change := range final {
+		if change.kind == changeDelete {
+			continue
+		}
+		for name, index := range manager.indexes {
+			if index.conflicts(change.key, change.item) {
+				undo()
+				return nil, fmt.Errorf("%w: %s: item %s", ErrUniqueViolation, name, change.key)
+			}
+		}
+	}
+	return undo, nil
+}
@@ -0,0 +1,104 @@
+package collection
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// QuarantineDir is the folder of a directory collection that bad item
+// files are moved to in LoadQuarantine mode
+const QuarantineDir = "_quarantine"
+
+var ErrUnreadableItems = errors.New("collection has unreadable items")
+
+// LoadMode decides what happens to item files that cannot be loaded
+type LoadMode int
+
+const (
+	// LoadSkip leaves bad files in place and lists them in the LoadReport
+	LoadSkip LoadMode = iota
+	// LoadStrict fails loading with ErrUnreadableItems
+	LoadStrict
+	// LoadQuarantine moves bad files into the QuarantineDir folder
+	LoadQuarantine
+)
+
+// WithLoadMode sets how bad item files are handled when a directory
+// collection is loaded (LoadSkip by default)
+func WithLoadMode(mode LoadMode) Option {
+	return func(c *config) {
+		c.loadMode = mode
+	}
+}
+
+// SkippedFile is an item file that was not loaded
+type SkippedFile struct {
+	Path          string
+	Reason        string
+	QuarantinedTo string // set in LoadQuarantine mode
+}
+
+// LoadReport describes how a collection was loaded
+type LoadReport struct {
+	Loaded  int
+	Skipped []SkippedFile
+}
+
+func (r LoadReport) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "loaded %d items, skipped %d files", r.Loaded, len(r.Skipped))
+	for _, skipped := range r.Skipped {
+		fmt.Fprintf(&b, "\n  %s: %s", skipped.Path, skipped.Reason)
+		if skipped.QuarantinedTo != "" {
+			fmt.Fprintf(&b, " (moved to %s)", skipped.QuarantinedTo)
+		}
+	}
+	return b.String()
+}
+
+// LoadReport returns the report of the initial load
+func (manager *Manager[T, ID]) LoadReport() LoadReport {
+	return manager.report
+}
+
+// skip records a bad file, moving it to the quarantine folder when
+// configured
+func (d *directoryStorage[T, ID]) skip(path, reason string) error {
+	skipped := SkippedFile{Path: path, Reason: reason}
+	if d.loadMode == LoadQuarantine {
+		target, err := d.quarantine(path)
+		if err != nil {
+			return fmt.Errorf("quarantining %s: %w", path, err)
+		}
+		skipped.QuarantinedTo = target
+	}
+	d.report.Skipped = append(d.report.Skipped, skipped)
+	return nil
+}
+
+func (d *directoryStorage[T, ID]) quarantine(path string) (string, error) {
+	rel, err := filepath.Rel(d.baseDir, path)
+	if err != nil {
+		return "", err
+	}
+	target := filepath.Join(d.baseDir, QuarantineDir, rel)
+	if _, err := os.Stat(target); err == nil {
+		target += "." + time.Now().UTC().Format("20060102T150405.000000000Z")
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", err
+	}
+	return target, os.Rename(path, target)
+}
+
+// checkReport fails strict loads that skipped files
+func (d *directoryStorage[T, ID]) checkReport() error {
+	if d.loadMode == LoadStrict && len(d.report.Skipped) > 0 {
+		return fmt.Errorf("%w: %s", ErrUnreadableItems, d.report)
+	}
+	return nil
+}
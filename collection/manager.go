@@ -0,0 +1,354 @@
+package collection
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mahdi-cpp/api-go-pkg/metadata"
+	"github.com/mahdi-cpp/api-go-pkg/registery"
+)
+
+var ErrNotFound = errors.New("item not found")
+
+// Item is the constraint for collection items. Timestamps are set through
+// either SetCreationDate/SetModificationDate or SetCreatedAt/SetUpdatedAt
+// when the item has them.
+type Item[ID comparable] interface {
+	GetID() ID
+	SetID(ID)
+}
+
+type Manager[T Item[ID], ID comparable] struct {
+	storage storage[T, ID]
+	items   *registery.Registry[T]
+	ids     IDGenerator[ID]
+
+	// mu serializes changes and guards the indexes and versions
+	mu       sync.RWMutex
+	indexes  map[string]Index[T]
+	versions map[string]int64 // stored version of each item, by key
+
+	trash   *trash[T, ID] // nil unless WithTrash
+	history *history[T]   // nil unless WithHistory
+	events  events[T]
+	report  LoadReport
+	expiry  atomic.Pointer[expiryFunc[T]] // nil unless SetExpiry
+}
+
+type SortOptions struct {
+	SortBy    string
+	SortOrder string
+}
+
+// NewManager loads the collection at path. The layout is detected from the
+// path (see LayoutAuto) unless WithLayout selects one.
+func NewManager[T Item[ID], ID comparable](path string, requireExist bool, ids IDGenerator[ID], options ...Option) (*Manager[T, ID], error) {
+	cfg := config{}
+	for _, option := range options {
+		option(&cfg)
+	}
+
+	store, err := openStorage[T, ID](path, cfg, requireExist)
+	if err != nil {
+		return nil, err
+	}
+	if persisted, ok := ids.(interface{ bind(string, config) }); ok {
+		persisted.bind(path, cfg)
+	}
+
+	manager := &Manager[T, ID]{
+		storage:  store,
+		items:    registery.NewRegistry[T](),
+		ids:      ids,
+		indexes:  make(map[string]Index[T]),
+		versions: make(map[string]int64),
+	}
+
+	items, err := manager.storage.ReadAll(requireExist)
+	if err != nil {
+		manager.Close()
+		return nil, fmt.Errorf("failed to load items: %w", err)
+	}
+	manager.report = LoadReport{Loaded: len(items)}
+	if dir, ok := store.(*directoryStorage[T, ID]); ok {
+		manager.report = dir.report
+	}
+
+	if cfg.history {
+		manager.history = newManagerHistory[T, ID](path, cfg, store)
+	}
+
+	if cfg.trash {
+		manager.trash = newTrash[T, ID](path, cfg)
+		trashed, err := manager.trash.list()
+		if err != nil {
+			manager.Close()
+			return nil, fmt.Errorf("failed to load trash: %w", err)
+		}
+		// Keep the ids of trashed items from being handed out again
+		for _, entry := range trashed {
+			manager.ids.Observe(entry.Item.GetID())
+		}
+	}
+
+	for _, item := range items {
+		manager.ids.Observe(item.GetID())
+		manager.register(item)
+	}
+
+	return manager, nil
+}
+
+func openStorage[T Item[ID], ID comparable](path string, cfg config, requireExist bool) (storage[T, ID], error) {
+	layout := cfg.layout
+	if layout == LayoutAuto {
+		layout = detectLayout(path)
+	}
+
+	switch layout {
+	case LayoutSingleFile:
+		return newSingleFileStorage[T, ID](path, cfg.metadata), nil
+	case LayoutJournal:
+		return newJournalStorage[T, ID](path, cfg.metadata, cfg.compactThreshold), nil
+	case LayoutBolt:
+		return newBoltStorage[T, ID](path, cfg, requireExist)
+	default:
+		return newDirectoryStorage[T, ID](path, cfg)
+	}
+}
+
+// sidecarPath returns the path of a file kept next to the collection, e.g.
+// albums.trash.json for albums.json or the albums directory
+func sidecarPath(path string, cfg config, name, ext string) string {
+	base := strings.TrimSuffix(filepath.Clean(path), filepath.Ext(path))
+	if cfg.bucket != "" {
+		base += "." + cfg.bucket
+	}
+	return base + "." + name + ext
+}
+
+func detectLayout(path string) Layout {
+	switch filepath.Ext(path) {
+	case JournalExtension:
+		return LayoutJournal
+	case BoltExtension:
+		return LayoutBolt
+	}
+
+	// Determine storage type based on path
+	if fi, err := os.Stat(path); err == nil {
+		if fi.IsDir() {
+			return LayoutDirectory
+		}
+		return LayoutSingleFile
+	}
+	if _, ok := metadata.CodecForPath(path); ok {
+		return LayoutSingleFile
+	}
+	return LayoutDirectory
+}
+
+// Watch keeps the in-memory registry in sync with changes other processes
+// make to the storage, until ctx is done
+func (manager *Manager[T, ID]) Watch(ctx context.Context) error {
+	return manager.storage.Watch(ctx, manager.applyChange)
+}
+
+func (manager *Manager[T, ID]) applyChange(change storageChange[T]) {
+	manager.mu.Lock()
+
+	listening := manager.events.snapshots != nil
+	var events []Event[T]
+	removeKey := func(key string) {
+		if _, ok := manager.versions[key]; !ok {
+			return
+		}
+		if listening {
+			events = append(events, manager.newEvent(EventDeleted, key, *new(T)))
+		}
+		manager.unregister(key)
+	}
+
+	if change.full {
+		keep := make(map[string]bool, len(change.items))
+		for _, item := range change.items {
+			keep[keyOf(item.GetID())] = true
+		}
+		for _, item := range manager.items.GetAllValues() {
+			if !keep[keyOf(item.GetID())] {
+				removeKey(keyOf(item.GetID()))
+			}
+		}
+	}
+	for _, item := range change.items {
+		key := keyOf(item.GetID())
+		version, existed := manager.versions[key]
+		switch {
+		case !listening:
+		case !existed:
+			events = append(events, manager.newEvent(EventCreated, key, item))
+		case version != versionOf(item):
+			events = append(events, manager.newEvent(EventUpdated, key, item))
+		}
+		manager.ids.Observe(item.GetID())
+		manager.register(item)
+	}
+	for _, key := range change.removed {
+		removeKey(key)
+	}
+
+	manager.publish(events)
+}
+
+// register adds a stored item to the registry, indexes and versions. Must
+// be called with mu held.
+func (manager *Manager[T, ID]) register(item T) {
+	key := keyOf(item.GetID())
+	manager.items.Register(key, item)
+	manager.versions[key] = versionOf(item)
+	manager.remember(key, item)
+	for _, index := range manager.indexes {
+		index.add(key, item)
+	}
+}
+
+// unregister must be called with mu held
+func (manager *Manager[T, ID]) unregister(key string) {
+	manager.items.Delete(key)
+	delete(manager.versions, key)
+	manager.forget(key)
+	for _, index := range manager.indexes {
+		index.remove(key)
+	}
+}
+
+func (manager *Manager[T, ID]) Create(newItem T) (T, error) {
+	err := manager.Tx(func(tx *Tx[T, ID]) error {
+		_, err := tx.Create(newItem)
+		return err
+	})
+	return newItem, err
+}
+
+func (manager *Manager[T, ID]) Update(updatedItem T) (T, error) {
+	err := manager.Tx(func(tx *Tx[T, ID]) error {
+		_, err := tx.Update(updatedItem)
+		return err
+	})
+	return updatedItem, err
+}
+
+func (manager *Manager[T, ID]) Delete(id ID) error {
+	return manager.Tx(func(tx *Tx[T, ID]) error {
+		return tx.Delete(id)
+	})
+}
+
+func (manager *Manager[T, ID]) Get(id ID) (T, error) {
+	item, err := manager.items.Get(keyOf(id))
+	if err != nil || manager.expired(item, time.Now()) {
+		var zero T
+		return zero, ErrNotFound
+	}
+	return item, nil
+}
+
+func (manager *Manager[T, ID]) GetList(filterFunc func(T) bool) ([]T, error) {
+	allItems := manager.items.GetAllValues()
+	now := time.Now()
+	var result []T
+	for _, item := range allItems {
+		if manager.expired(item, now) {
+			continue
+		}
+		if filterFunc == nil || filterFunc(item) {
+			result = append(result, item)
+		}
+	}
+	return result, nil
+}
+
+func (manager *Manager[T, ID]) GetAll() ([]T, error) {
+	if manager.expiry.Load() != nil {
+		return manager.GetList(nil)
+	}
+	return manager.items.GetAllValues(), nil
+}
+
+func (manager *Manager[T, ID]) GetBy(filterFunc func(T) bool) ([]T, error) {
+	return manager.GetList(filterFunc)
+}
+
+func (manager *Manager[T, ID]) SortItems(items []T, options SortOptions) []T {
+	if options.SortBy == "" {
+		return items
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		a := items[i]
+		b := items[j]
+
+		switch options.SortBy {
+		case "id":
+			if options.SortOrder == "asc" {
+				return compareIDs(a.GetID(), b.GetID()) < 0
+			}
+			return compareIDs(a.GetID(), b.GetID()) > 0
+		case "creationDate":
+			if options.SortOrder == "asc" {
+				return createdOf(a).Before(createdOf(b))
+			}
+			return createdOf(a).After(createdOf(b))
+		case "modificationDate":
+			if options.SortOrder == "asc" {
+				return modifiedOf(a).Before(modifiedOf(b))
+			}
+			return modifiedOf(a).After(modifiedOf(b))
+		default:
+			return false
+		}
+	})
+
+	return items
+}
+
+func (manager *Manager[T, ID]) GetSortedList(filterFunc func(T) bool, sortBy string, sortOrder string) ([]T, error) {
+	items, err := manager.GetList(filterFunc)
+	if err != nil {
+		return nil, err
+	}
+	return manager.SortItems(items, SortOptions{
+		SortBy:    sortBy,
+		SortOrder: sortOrder,
+	}), nil
+}
+
+func (manager *Manager[T, ID]) GetAllSorted(sortBy string, sortOrder string) ([]T, error) {
+	items, err := manager.GetAll()
+	if err != nil {
+		return nil, err
+	}
+	return manager.SortItems(items, SortOptions{SortBy: sortBy, SortOrder: sortOrder}), nil
+}
+
+// compareIDs orders integer ids numerically and everything else as strings
+func compareIDs[ID comparable](a, b ID) int {
+	va, vb := reflect.ValueOf(a), reflect.ValueOf(b)
+	switch va.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return cmp.Compare(va.Int(), vb.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return cmp.Compare(va.Uint(), vb.Uint())
+	}
+	return cmp.Compare(keyOf(a), keyOf(b))
+}
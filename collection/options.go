@@ -0,0 +1,97 @@
+package collection
+
+import (
+	"time"
+
+	"github.com/mahdi-cpp/api-go-pkg/metadata"
+)
+
+// Option configures a Manager
+type Option func(*config)
+
+type config struct {
+	metadata         []metadata.Option
+	layout           Layout
+	compactThreshold int
+	trash            bool
+	trashRetention   time.Duration
+	sharder          Sharder
+	bucket           string
+	history          bool
+	historyLimit     int
+	loadMode         LoadMode
+}
+
+// Layout selects how a collection is stored on disk
+type Layout int
+
+const (
+	// LayoutAuto picks the layout from the path: an existing directory or a
+	// path without extension is a directory, a .journal path a journal, a
+	// .db path a bolt database and any other codec extension a single file
+	LayoutAuto Layout = iota
+	// LayoutSingleFile stores all items as one array in a single file
+	LayoutSingleFile
+	// LayoutDirectory stores each item in <dir>/<id>.json, or in
+	// <dir>/<shard>/<id>.json with WithSharding
+	LayoutDirectory
+	// LayoutJournal appends every change to a log and folds it into
+	// <path>.snapshot in the background
+	LayoutJournal
+	// LayoutBolt stores the items in a bucket of a bolt database
+	LayoutBolt
+)
+
+// JournalExtension marks a path as a journal for LayoutAuto
+const JournalExtension = ".journal"
+
+// WithLayout overrides the layout detected from the path
+func WithLayout(layout Layout) Option {
+	return func(c *config) {
+		c.layout = layout
+	}
+}
+
+// WithBucket sets the bucket of a bolt collection; the file name without
+// extension is used by default
+func WithBucket(name string) Option {
+	return func(c *config) {
+		c.bucket = name
+	}
+}
+
+// WithCompactThreshold sets how many journal records trigger a background
+// compaction (DefaultCompactThreshold when zero)
+func WithCompactThreshold(records int) Option {
+	return func(c *config) {
+		c.compactThreshold = records
+	}
+}
+
+// WithTrash makes Delete move items to the trash instead of removing them.
+// PurgeExpired removes them once they are older than retention; zero keeps
+// them until Purge.
+func WithTrash(retention time.Duration) Option {
+	return func(c *config) {
+		c.trash = true
+		c.trashRetention = retention
+	}
+}
+
+// WithHistory keeps the last limit revisions of every item (all of them
+// when zero). Directory collections keep them in <id>.history next to the
+// item, other layouts in a shared <name>.history.jsonl log.
+func WithHistory(limit int) Option {
+	return func(c *config) {
+		c.history = true
+		c.historyLimit = limit
+	}
+}
+
+// WithMetadataOptions passes options (codec, locking, encryption, ...) to
+// the metadata.Control instances the storage uses
+func WithMetadataOptions(options ...metadata.Option) Option {
+	return func(c *config) {
+		c.metadata = append(c.metadata, options...)
+	}
+}
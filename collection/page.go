@@ -0,0 +1,151 @@
+package collection
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+)
+
+var (
+	ErrInvalidCursor  = errors.New("invalid cursor")
+	ErrUnknownSortKey = errors.New("unknown sort key")
+)
+
+// DefaultPageLimit is the page size when PageQuery.Limit is zero
+var DefaultPageLimit = 50
+
+// PageQuery selects one page of a filtered and sorted list
+type PageQuery[T any] struct {
+	Filter func(T) bool
+	// Sort accepts the same SortBy values as SortItems and defaults to id
+	// ascending. Items with equal sort keys are ordered by id.
+	Sort   SortOptions
+	Limit  int
+	Cursor string // NextCursor or PrevCursor of an earlier page, "" for the first page
+}
+
+type Page[T any] struct {
+	Items      []T
+	NextCursor string // "" on the last page
+	PrevCursor string // "" on the first page
+	Total      int    // number of items matching the filter
+}
+
+// cursor marks a position between items by the sort key and id of the item
+// next to it
+type cursor[ID comparable] struct {
+	Sort   string    `json:"sort"`
+	At     time.Time `json:"at,omitzero"`
+	ID     ID        `json:"id"`
+	Before bool      `json:"before,omitempty"` // page backwards from here
+}
+
+// Page returns the items after (or, for a PrevCursor, before) the cursor.
+// Cursors point at items rather than offsets, so pages stay stable while
+// items are created or deleted.
+func (manager *Manager[T, ID]) Page(query PageQuery[T]) (Page[T], error) {
+	var page Page[T]
+
+	options := query.Sort
+	if options.SortBy == "" {
+		options = SortOptions{SortBy: "id", SortOrder: "asc"}
+	}
+	sortKey, err := sortKeyFunc[T](options.SortBy)
+	if err != nil {
+		return page, err
+	}
+	desc := options.SortOrder != "asc"
+	sortName := options.SortBy + ":asc"
+	if desc {
+		sortName = options.SortBy + ":desc"
+	}
+
+	limit := query.Limit
+	if limit <= 0 {
+		limit = DefaultPageLimit
+	}
+
+	items, err := manager.GetList(query.Filter)
+	if err != nil {
+		return page, err
+	}
+	page.Total = len(items)
+
+	// compare orders an item against a position, in page order
+	compare := func(item T, at time.Time, id ID) int {
+		c := sortKey(item).Compare(at)
+		if c == 0 {
+			c = compareIDs(item.GetID(), id)
+		}
+		if desc {
+			return -c
+		}
+		return c
+	}
+	sort.Slice(items, func(i, j int) bool {
+		return compare(items[i], sortKey(items[j]), items[j].GetID()) < 0
+	})
+
+	start, end := 0, min(limit, len(items))
+	if query.Cursor != "" {
+		c, err := decodeCursor[ID](query.Cursor)
+		if err != nil {
+			return page, err
+		}
+		if c.Sort != sortName {
+			return page, fmt.Errorf("%w: cursor is for sort %s, not %s", ErrInvalidCursor, c.Sort, sortName)
+		}
+		if c.Before {
+			end = sort.Search(len(items), func(i int) bool { return compare(items[i], c.At, c.ID) >= 0 })
+			start = max(0, end-limit)
+		} else {
+			start = sort.Search(len(items), func(i int) bool { return compare(items[i], c.At, c.ID) > 0 })
+			end = min(start+limit, len(items))
+		}
+	}
+
+	page.Items = items[start:end]
+	if end < len(items) && end > 0 {
+		last := items[end-1]
+		page.NextCursor = encodeCursor(cursor[ID]{Sort: sortName, At: sortKey(last), ID: last.GetID()})
+	}
+	if start > 0 && start < len(items) {
+		first := items[start]
+		page.PrevCursor = encodeCursor(cursor[ID]{Sort: sortName, At: sortKey(first), ID: first.GetID(), Before: true})
+	}
+	return page, nil
+}
+
+// sortKeyFunc returns the time an item is sorted by; sorting by id uses a
+// zero time so only the id decides
+func sortKeyFunc[T any](sortBy string) (func(T) time.Time, error) {
+	switch sortBy {
+	case "id":
+		return func(T) time.Time { return time.Time{} }, nil
+	case "creationDate":
+		return func(item T) time.Time { return createdOf(item) }, nil
+	case "modificationDate":
+		return func(item T) time.Time { return modifiedOf(item) }, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnknownSortKey, sortBy)
+}
+
+func encodeCursor[ID comparable](c cursor[ID]) string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeCursor[ID comparable](value string) (cursor[ID], error) {
+	var c cursor[ID]
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return c, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	if err := json.Unmarshal(data, &c); err != nil {
+		return c, fmt.Errorf("%w: %v", ErrInvalidCursor, err)
+	}
+	return c, nil
+}
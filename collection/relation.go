@@ -0,0 +1,293 @@
+package collection
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sync"
+	"time"
+)
+
+var (
+	ErrReferenced        = errors.New("item is still referenced")
+	ErrDanglingReference = errors.New("referenced item does not exist")
+	ErrRelationCycle     = errors.New("relation would form a cycle")
+	ErrInvalidRelation   = errors.New("invalid relation")
+)
+
+// OnDelete decides what happens to the items referencing a deleted item
+type OnDelete int
+
+const (
+	// Restrict refuses to delete an item that is still referenced
+	Restrict OnDelete = iota
+	// Cascade deletes the items referencing it
+	Cascade
+	// SetNull removes the reference from the items referencing it
+	SetNull
+)
+
+func (o OnDelete) String() string {
+	switch o {
+	case Restrict:
+		return "restrict"
+	case Cascade:
+		return "cascade"
+	case SetNull:
+		return "set null"
+	}
+	return fmt.Sprintf("OnDelete(%d)", int(o))
+}
+
+// RelationSpec describes how the items of a child collection reference
+// the items of a parent collection. Set Ref for one-to-many relations,
+// e.g. the chat of a message, or Refs for many-to-many ones, e.g. the
+// assets of a message.
+type RelationSpec[C any, PID comparable] struct {
+	Ref  func(C) PID   // the zero id references nothing
+	Refs func(C) []PID // zero ids are ignored
+
+	// Unset removes the reference to parent from item; SetNull needs it
+	Unset func(item C, parent PID) C
+
+	OnDelete OnDelete
+}
+
+// Relation keeps the references from a child collection to a parent
+// collection intact. Children can only reference existing parents, and
+// deleting a parent restricts, cascades or sets null as configured.
+//
+// The children are cascaded or set null in their own commit, made while
+// the parent's Manager is locked, right before the parent is written. If
+// the child commit fails, e.g. because a hook vetoes it, the parent is not
+// deleted; if writing the parent fails, the children are changed back.
+// Event hooks of the child must not change the parent.
+type Relation[P Item[PID], PID comparable, C Item[CID], CID comparable] struct {
+	name     string
+	parent   *Manager[P, PID]
+	child    *Manager[C, CID]
+	refs     func(C) []PID
+	unset    func(C, PID) C
+	onDelete OnDelete
+
+	// deleting holds the keys of parents whose delete is being committed,
+	// which new references are refused for
+	mu       sync.Mutex
+	deleting map[string]bool
+}
+
+// relationGraph links each parent Manager to its child Managers. Cascades
+// lock the child while the parent is locked, so cycles would deadlock.
+var relationGraph = struct {
+	sync.Mutex
+	children map[any][]any
+}{children: make(map[any][]any)}
+
+// NewRelation relates the items of child to the items of parent. It adds
+// the index "relation:<name>" to child, mapping parent ids to children.
+func NewRelation[P Item[PID], PID comparable, C Item[CID], CID comparable](name string, parent *Manager[P, PID], child *Manager[C, CID], spec RelationSpec[C, PID]) (*Relation[P, PID, C, CID], error) {
+	refs := spec.Refs
+	switch {
+	case (spec.Ref == nil) == (spec.Refs == nil):
+		return nil, fmt.Errorf("%w: %s: set either Ref or Refs", ErrInvalidRelation, name)
+	case spec.OnDelete == SetNull && spec.Unset == nil:
+		return nil, fmt.Errorf("%w: %s: SetNull needs Unset", ErrInvalidRelation, name)
+	case spec.Ref != nil:
+		refs = func(item C) []PID { return []PID{spec.Ref(item)} }
+	}
+
+	relation := &Relation[P, PID, C, CID]{
+		name:   name,
+		parent: parent,
+		child:  child,
+		refs: func(item C) []PID {
+			var ids []PID
+			for _, id := range refs(item) {
+				if id != *new(PID) {
+					ids = append(ids, id)
+				}
+			}
+			return ids
+		},
+		unset:    spec.Unset,
+		onDelete: spec.OnDelete,
+		deleting: make(map[string]bool),
+	}
+
+	if err := linkRelation(parent, child); err != nil {
+		return nil, fmt.Errorf("%w: %s", err, name)
+	}
+	if err := child.AddIndex(relation.indexName(), NewIndex(relation.refs)); err != nil {
+		return nil, err
+	}
+	child.BeforeCommit(relation.checkChild)
+	parent.stage(relation.stageParent)
+	return relation, nil
+}
+
+// linkRelation records the edge from parent to child unless child can
+// already reach parent
+func linkRelation(parent, child any) error {
+	relationGraph.Lock()
+	defer relationGraph.Unlock()
+
+	seen := make(map[any]bool)
+	pending := []any{child}
+	for len(pending) > 0 {
+		next := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if next == parent {
+			return ErrRelationCycle
+		}
+		if !seen[next] {
+			seen[next] = true
+			pending = append(pending, relationGraph.children[next]...)
+		}
+	}
+	relationGraph.children[parent] = append(relationGraph.children[parent], child)
+	return nil
+}
+
+func (r *Relation[P, PID, C, CID]) indexName() string {
+	return "relation:" + r.name
+}
+
+// checkChild refuses children that reference a missing parent. Only
+// references the change adds are checked.
+func (r *Relation[P, PID, C, CID]) checkChild(event Event[C]) error {
+	if event.Type == EventDeleted {
+		return nil
+	}
+
+	var before []PID
+	if event.Type == EventUpdated {
+		before = r.refs(event.Before)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, id := range r.refs(event.After) {
+		if slices.Contains(before, id) {
+			continue
+		}
+		key := keyOf(id)
+		if _, err := r.parent.items.Get(key); err != nil || r.deleting[key] {
+			return fmt.Errorf("%w: %s: %s", ErrDanglingReference, r.name, key)
+		}
+	}
+	return nil
+}
+
+// stageParent checks a parent delete against the children. The step it
+// returns applies the OnDelete behavior before the parent is written.
+func (r *Relation[P, PID, C, CID]) stageParent(event Event[P]) (commitStep, error) {
+	if event.Type != EventDeleted {
+		return commitStep{}, nil
+	}
+
+	r.mu.Lock()
+	r.deleting[event.Key] = true
+	r.mu.Unlock()
+	done := func() {
+		r.mu.Lock()
+		delete(r.deleting, event.Key)
+		r.mu.Unlock()
+	}
+
+	// Children referencing the parent cannot be added any more, so the
+	// ones found here are all there will be
+	id := event.Before.GetID()
+	r.child.mu.RLock()
+	keys, _ := r.child.indexes[r.indexName()].lookup(id)
+	r.child.mu.RUnlock()
+	switch {
+	case len(keys) == 0:
+		return commitStep{finish: done}, nil
+	case r.onDelete == Restrict:
+		done()
+		return commitStep{}, fmt.Errorf("%w: %s: %s", ErrReferenced, r.name, event.Key)
+	}
+
+	var undo func()
+	return commitStep{
+		apply: func() error {
+			var err error
+			_, undo, err = r.child.commitReversible(func() ([]itemChange[C], error) {
+				keys, _ := r.child.indexes[r.indexName()].lookup(id)
+				return r.childChanges(id, keys), nil
+			})
+			if err != nil {
+				return fmt.Errorf("%s %s of %s: %w", r.onDelete, r.name, event.Key, err)
+			}
+			return nil
+		},
+		revert: func() {
+			// The parent stays, so the restored children may reference it
+			done()
+			if undo != nil {
+				undo()
+			}
+		},
+		finish: done,
+	}, nil
+}
+
+// childChanges cascades or sets null the children with the given keys.
+// Must be called with the child's mu held.
+func (r *Relation[P, PID, C, CID]) childChanges(id PID, keys []string) []itemChange[C] {
+	changes := make([]itemChange[C], 0, len(keys))
+	for _, key := range keys {
+		if r.onDelete == Cascade {
+			changes = append(changes, itemChange[C]{kind: changeDelete, key: key})
+			continue
+		}
+		// Unset a copy, the registered item must not change before the commit
+		item, ok := r.child.events.snapshots[key]
+		if !ok {
+			continue
+		}
+		item = r.unset(item, id)
+		setModified(item, time.Now())
+		changes = append(changes, itemChange[C]{kind: changeUpdate, key: key, item: item})
+	}
+	return changes
+}
+
+// Parent returns the parent a child references, for one-to-many relations
+func (r *Relation[P, PID, C, CID]) Parent(child C) (P, error) {
+	refs := r.refs(child)
+	if len(refs) == 0 {
+		var zero P
+		return zero, ErrNotFound
+	}
+	return r.parent.Get(refs[0])
+}
+
+// Parents returns the parents a child references, skipping missing ones
+func (r *Relation[P, PID, C, CID]) Parents(child C) ([]P, error) {
+	var parents []P
+	for _, id := range r.refs(child) {
+		if item, err := r.parent.Get(id); err == nil {
+			parents = append(parents, item)
+		}
+	}
+	return parents, nil
+}
+
+// Children returns the items referencing the parent with the given id
+func (r *Relation[P, PID, C, CID]) Children(id PID) ([]C, error) {
+	return r.child.GetByIndex(r.indexName(), id)
+}
+
+// Dangling returns the children referencing a missing parent, e.g. ones
+// stored before the relation was declared
+func (r *Relation[P, PID, C, CID]) Dangling() ([]C, error) {
+	return r.child.GetList(func(item C) bool {
+		for _, id := range r.refs(item) {
+			if _, err := r.parent.items.Get(keyOf(id)); err != nil {
+				return true
+			}
+		}
+		return false
+	})
+}
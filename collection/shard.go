@@ -0,0 +1,297 @@
+package collection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/oklog/ulid/v2"
+
+	"github.com/mahdi-cpp/api-go-pkg/metadata"
+)
+
+// ShardingFile records the Sharder of a directory collection, so it is
+// detected when the directory is opened
+const ShardingFile = ".sharding"
+
+var ErrShardingMismatch = errors.New("directory is sharded differently")
+
+// Sharder spreads the files of a directory collection over subdirectories
+type Sharder interface {
+	// Shard returns the subdirectory for an item key, "" for the base
+	// directory
+	Shard(key string) string
+	// String describes the sharder; ParseSharder turns it back
+	String() string
+}
+
+// RangeShards groups integer ids into directories of size ids each, e.g.
+// 00001000/ holds ids 1000 to 1999
+func RangeShards(size int) Sharder {
+	return rangeShards(max(size, 1))
+}
+
+type rangeShards int
+
+func (s rangeShards) Shard(key string) string {
+	id, err := strconv.Atoi(key)
+	if err != nil || id < 0 {
+		return ""
+	}
+	return fmt.Sprintf("%08d", id/int(s)*int(s))
+}
+
+func (s rangeShards) String() string { return "range:" + strconv.Itoa(int(s)) }
+
+// HashShards uses the first width hex digits of a hash of the key, e.g.
+// 2 gives 256 directories
+func HashShards(width int) Sharder {
+	return hashShards(min(max(width, 1), 8))
+}
+
+type hashShards int
+
+func (s hashShards) Shard(key string) string {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return fmt.Sprintf("%08x", h.Sum32())[:s]
+}
+
+func (s hashShards) String() string { return "hash:" + strconv.Itoa(int(s)) }
+
+// TimeShards formats the time embedded in UUIDv7 and ULID ids with layout,
+// e.g. "2006/01" for one directory per month. Other ids stay in the base
+// directory.
+func TimeShards(layout string) Sharder {
+	return timeShards(layout)
+}
+
+type timeShards string
+
+func (s timeShards) Shard(key string) string {
+	if id, err := uuid.Parse(key); err == nil && id.Version() == 7 {
+		sec, nsec := id.Time().UnixTime()
+		return time.Unix(sec, nsec).UTC().Format(string(s))
+	}
+	if id, err := ulid.ParseStrict(key); err == nil {
+		return ulid.Time(id.Time()).UTC().Format(string(s))
+	}
+	return ""
+}
+
+func (s timeShards) String() string { return "time:" + string(s) }
+
+// ParseSharder returns the Sharder described by Sharder.String
+func ParseSharder(spec string) (Sharder, error) {
+	kind, arg, _ := strings.Cut(strings.TrimSpace(spec), ":")
+	switch kind {
+	case "range", "hash":
+		n, err := strconv.Atoi(arg)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid sharder %q", spec)
+		}
+		if kind == "range" {
+			return RangeShards(n), nil
+		}
+		return HashShards(n), nil
+	case "time":
+		if arg == "" {
+			return nil, fmt.Errorf("invalid sharder %q", spec)
+		}
+		return TimeShards(arg), nil
+	}
+	return nil, fmt.Errorf("unknown sharder %q", spec)
+}
+
+// WithSharding fans the files of a directory collection out over
+// subdirectories. Opening a directory sharded another way fails; use
+// MigrateSharding to convert it.
+func WithSharding(sharder Sharder) Option {
+	return func(c *config) {
+		c.sharder = sharder
+	}
+}
+
+// readSharding returns the Sharder recorded in a directory, nil when flat
+func readSharding(baseDir string) (Sharder, error) {
+	data, err := os.ReadFile(filepath.Join(baseDir, ShardingFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseSharder(string(data))
+}
+
+func writeSharding(baseDir string, sharder Sharder) error {
+	path := filepath.Join(baseDir, ShardingFile)
+	if sharder == nil {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	if err := os.MkdirAll(baseDir, 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, []byte(sharder.String()+"\n"), 0644)
+}
+
+// walkItems calls fn with the key and path of every file with extension ext
+// below baseDir. Directories starting with "." or "_" are skipped.
+func walkItems(baseDir, ext string, fn func(key, path string) error) error {
+	return filepath.WalkDir(baseDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		name := entry.Name()
+		if entry.IsDir() {
+			if path != baseDir && (strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Ext(name) != ext {
+			return nil
+		}
+		return fn(strings.TrimSuffix(name, ext), path)
+	})
+}
+
+// MigrateSharding moves the files of a directory collection to the layout of
+// sharder (flat when nil), in place. Readers find every file at any point,
+// but no Manager may write to the directory while it runs.
+func MigrateSharding(baseDir string, sharder Sharder, options ...Option) error {
+	cfg := config{}
+	for _, option := range options {
+		option(&cfg)
+	}
+	ext := metadata.ResolveCodec("", cfg.metadata...).Extension()
+
+	// Flatten first: while the old sharding is recorded, files are found in
+	// their shard or the base directory
+	for _, ext := range []string{ext, HistoryExtension} {
+		if err := moveItems(baseDir, ext, nil); err != nil {
+			return err
+		}
+	}
+	if err := writeSharding(baseDir, sharder); err != nil {
+		return err
+	}
+	if sharder == nil {
+		return nil
+	}
+	for _, ext := range []string{ext, HistoryExtension} {
+		if err := moveItems(baseDir, ext, sharder); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func moveItems(baseDir, ext string, sharder Sharder) error {
+	type move struct{ from, to string }
+	var moves []move
+	err := walkItems(baseDir, ext, func(key, path string) error {
+		target := filepath.Join(baseDir, key+ext)
+		if sharder != nil {
+			target = filepath.Join(baseDir, sharder.Shard(key), key+ext)
+		}
+		if target != path {
+			moves = append(moves, move{path, target})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, m := range moves {
+		if err := os.MkdirAll(filepath.Dir(m.to), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(m.from, m.to); err != nil {
+			return err
+		}
+	}
+	return removeEmptyDirs(baseDir)
+}
+
+// removeEmptyDirs removes the shard directories left empty by moves and
+// deletes
+func removeEmptyDirs(baseDir string) error {
+	var dirs []string
+	err := filepath.WalkDir(baseDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || !entry.IsDir() || path == baseDir {
+			return err
+		}
+		if name := entry.Name(); strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_") {
+			return filepath.SkipDir
+		}
+		dirs = append(dirs, path)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Children come after their parents in walk order
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if entries, err := os.ReadDir(dirs[i]); err == nil && len(entries) == 0 {
+			os.Remove(dirs[i])
+		}
+	}
+	return nil
+}
+
+// pollTree calls onChange with the path of every item file below baseDir
+// that appears, changes or disappears, until ctx is done. fsnotify does not
+// watch subdirectories, so sharded directories are polled.
+func pollTree(ctx context.Context, baseDir, ext string, onChange func(key, path string)) error {
+	scan := func() map[string]metadata.FileSignature {
+		files := make(map[string]metadata.FileSignature)
+		walkItems(baseDir, ext, func(key, path string) error {
+			if sig, err := metadata.StatSignature(path); err == nil {
+				files[path] = sig
+			}
+			return nil
+		})
+		return files
+	}
+
+	known := scan()
+	go func() {
+		ticker := time.NewTicker(metadata.DefaultPollInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			current := scan()
+			for path, sig := range current {
+				if old, ok := known[path]; !ok || !old.Equal(sig) {
+					onChange(strings.TrimSuffix(filepath.Base(path), ext), path)
+				}
+			}
+			for path := range known {
+				if _, ok := current[path]; !ok {
+					onChange(strings.TrimSuffix(filepath.Base(path), ext), path)
+				}
+			}
+			known = current
+		}
+	}()
+	return nil
+}
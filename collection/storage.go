@@ -0,0 +1,392 @@
+package collection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/mahdi-cpp/api-go-pkg/metadata"
+)
+
+type storage[T Item[ID], ID comparable] interface {
+	ReadAll(requireExist bool) ([]T, error)
+	Apply(changes []itemChange[T]) error
+	Watch(ctx context.Context, onChange func(change storageChange[T])) error
+}
+
+// storageChange describes a change another process made to the storage
+type storageChange[T any] struct {
+	items   []T      // created or changed items
+	removed []string // keys of deleted items
+	full    bool     // items is the complete collection
+}
+
+type changeKind int
+
+const (
+	changeCreate changeKind = iota
+	changeUpdate
+	changeDelete
+)
+
+// itemChange is one write of a batch applied through storage.Apply
+type itemChange[T any] struct {
+	kind changeKind
+	key  string
+	item T // zero for deletes
+
+	// checkVersion makes the change fail unless the stored version is expected
+	checkVersion bool
+	expected     int64
+
+	actor string // recorded in the history
+
+	// fresh marks creates with a newly allocated id, which cannot be in
+	// the trash
+	fresh bool
+}
+
+// keyOf turns an id into the string used for registry keys and file names
+func keyOf[ID comparable](id ID) string {
+	return fmt.Sprint(id)
+}
+
+type singleFileStorage[T Item[ID], ID comparable] struct {
+	ctrl *metadata.Control[[]T]
+}
+
+func newSingleFileStorage[T Item[ID], ID comparable](path string, options []metadata.Option) *singleFileStorage[T, ID] {
+	// Migrations are written per item, apply them to each array element
+	options = append(options[:len(options):len(options)], metadata.WithElementMigrations())
+	return &singleFileStorage[T, ID]{ctrl: metadata.NewMetadataControl[[]T](path, options...)}
+}
+
+func (s *singleFileStorage[T, ID]) ReadAll(requireExist bool) ([]T, error) {
+	dataPtr, err := s.ctrl.Read(requireExist)
+	if err != nil {
+		return nil, err
+	}
+	if dataPtr == nil {
+		return []T{}, nil
+	}
+	return *dataPtr, nil
+}
+
+// Apply rewrites the file once for the whole batch, streaming the stored
+// items: changed ones are replaced or dropped in place, new ones appended
+func (s *singleFileStorage[T, ID]) Apply(changes []itemChange[T]) error {
+	byKey := make(map[string][]int)
+	for i, change := range changes {
+		byKey[change.key] = append(byKey[change.key], i)
+	}
+
+	var appended []keyOutcome[T]
+	found := make(map[string]bool)
+	return metadata.RewriteAndAppendElements(s.ctrl, func(item T) (T, bool, error) {
+		key := keyOf(item.GetID())
+		indices, ok := byKey[key]
+		if !ok {
+			return item, true, nil
+		}
+		found[key] = true
+		outcome, err := foldChanges(changes, indices, item, true)
+		if err != nil {
+			return item, false, err
+		}
+		if !outcome.inPlace && outcome.live {
+			appended = append(appended, outcome)
+		}
+		return outcome.item, outcome.inPlace, nil
+	}, func() ([]T, error) {
+		for key, indices := range byKey {
+			if found[key] {
+				continue
+			}
+			var zero T
+			outcome, err := foldChanges(changes, indices, zero, false)
+			if err != nil {
+				return nil, err
+			}
+			if outcome.live {
+				appended = append(appended, outcome)
+			}
+		}
+		// New items go to the end in the order they were created
+		slices.SortFunc(appended, func(a, b keyOutcome[T]) int { return a.since - b.since })
+		items := make([]T, len(appended))
+		for i, outcome := range appended {
+			items[i] = outcome.item
+		}
+		return items, nil
+	})
+}
+
+// keyOutcome is what the changes of a batch leave of one key
+type keyOutcome[T any] struct {
+	item    T
+	live    bool
+	inPlace bool // keeps its position in the file
+	since   int  // index of the change that appended it
+}
+
+// foldChanges applies the changes with the given indices, all for the same
+// key, to item, which is stored when exists
+func foldChanges[T any](changes []itemChange[T], indices []int, item T, exists bool) (keyOutcome[T], error) {
+	outcome := keyOutcome[T]{item: item, live: exists, inPlace: exists}
+	for _, i := range indices {
+		change := changes[i]
+		switch change.kind {
+		case changeDelete:
+			outcome.live, outcome.inPlace = false, false
+		case changeUpdate:
+			if !outcome.live {
+				return outcome, ErrNotFound
+			}
+			outcome.item = change.item
+		default:
+			if !outcome.live {
+				outcome.live, outcome.since = true, i
+			}
+			outcome.item = change.item
+		}
+	}
+	return outcome, nil
+}
+
+func (s *singleFileStorage[T, ID]) Watch(ctx context.Context, onChange func(change storageChange[T])) error {
+	return s.ctrl.Watch(ctx, func(data *[]T, err error) {
+		if err != nil {
+			log.Printf("collection: reloading items: %v", err)
+			return
+		}
+		onChange(storageChange[T]{items: *data, full: true})
+	})
+}
+
+type directoryStorage[T Item[ID], ID comparable] struct {
+	baseDir string
+	ext     string
+	options []metadata.Option
+	sharder Sharder // nil for a flat directory
+
+	loadMode LoadMode
+	report   LoadReport // of the last ReadAll
+
+	// written remembers our own writes so Watch can skip them
+	writtenMu sync.Mutex
+	written   map[string]metadata.FileSignature
+}
+
+func newDirectoryStorage[T Item[ID], ID comparable](baseDir string, cfg config) (*directoryStorage[T, ID], error) {
+	options, sharder := cfg.metadata, cfg.sharder
+	recorded, err := readSharding(baseDir)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case sharder == nil:
+		sharder = recorded
+	case recorded == nil:
+		// Flat files are still found until MigrateSharding moves them
+		if err := writeSharding(baseDir, sharder); err != nil {
+			return nil, err
+		}
+	case recorded.String() != sharder.String():
+		return nil, fmt.Errorf("%w: %s is %s, not %s", ErrShardingMismatch, baseDir, recorded, sharder)
+	}
+
+	return &directoryStorage[T, ID]{
+		baseDir:  baseDir,
+		ext:      metadata.ResolveCodec("", options...).Extension(),
+		options:  options,
+		sharder:  sharder,
+		loadMode: cfg.loadMode,
+		written:  make(map[string]metadata.FileSignature),
+	}, nil
+}
+
+// itemPath returns where the file of a new item goes
+func (d *directoryStorage[T, ID]) itemPath(key string) string {
+	if d.sharder != nil {
+		return filepath.Join(d.baseDir, d.sharder.Shard(key), key+d.ext)
+	}
+	return filepath.Join(d.baseDir, key+d.ext)
+}
+
+// locate returns the file of an existing item, which may still be in the
+// base directory of a sharded collection
+func (d *directoryStorage[T, ID]) locate(key string) string {
+	path := d.itemPath(key)
+	if d.sharder == nil {
+		return path
+	}
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		flat := filepath.Join(d.baseDir, key+d.ext)
+		if _, err := os.Stat(flat); err == nil {
+			return flat
+		}
+	}
+	return path
+}
+
+func (d *directoryStorage[T, ID]) ReadAll(requireExist bool) ([]T, error) {
+	if _, err := os.Stat(d.baseDir); err != nil {
+		if os.IsNotExist(err) {
+			if requireExist {
+				return nil, err
+			}
+			return []T{}, nil
+		}
+		return nil, err
+	}
+
+	var items []T
+	d.report = LoadReport{}
+	// Files written by other codecs have another extension and are skipped
+	err := walkItems(d.baseDir, d.ext, func(key, path string) error {
+		item, err := d.readItem(path)
+		if err != nil {
+			return d.skip(path, err.Error())
+		}
+		// The file name must match the id stored inside
+		if id := keyOf(item.GetID()); id != key {
+			return d.skip(path, fmt.Sprintf("file name does not match id %q", id))
+		}
+		items = append(items, item)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	d.report.Loaded = len(items)
+	if err := d.checkReport(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+func (d *directoryStorage[T, ID]) readItem(path string) (T, error) {
+	var zero T
+	ctrl := metadata.NewMetadataControl[T](path, d.options...)
+
+	dataPtr, err := ctrl.Read(true)
+	if err != nil {
+		return zero, err
+	}
+	if dataPtr == nil {
+		return zero, errors.New("metadata not found")
+	}
+	return *dataPtr, nil
+}
+
+// Apply writes one file per change. Every item is its own file, so a batch
+// cannot be written at once; when a write fails the earlier ones are undone.
+func (d *directoryStorage[T, ID]) Apply(changes []itemChange[T]) error {
+	// Ensure directory exists
+	if err := os.MkdirAll(d.baseDir, 0755); err != nil {
+		return err
+	}
+
+	var undo []func()
+	for _, change := range changes {
+		path := d.locate(change.key)
+		previous, readErr := os.ReadFile(path)
+
+		var err error
+		if change.kind == changeDelete {
+			err = d.removeItem(path)
+		} else {
+			err = d.writeItem(change.item)
+		}
+		if err != nil {
+			for i := len(undo) - 1; i >= 0; i-- {
+				undo[i]()
+			}
+			return err
+		}
+
+		undo = append(undo, func() {
+			if readErr == nil {
+				os.WriteFile(path, previous, 0644)
+			} else {
+				os.Remove(path)
+			}
+			d.recordWrite(path)
+		})
+	}
+	return nil
+}
+
+func (d *directoryStorage[T, ID]) writeItem(item T) error {
+	path := d.locate(keyOf(item.GetID()))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	ctrl := metadata.NewMetadataControl[T](path, d.options...)
+	if err := ctrl.Write(&item); err != nil {
+		return err
+	}
+	d.recordWrite(path)
+	return nil
+}
+
+func (d *directoryStorage[T, ID]) removeItem(path string) error {
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	d.recordWrite(path)
+	return nil
+}
+
+func (d *directoryStorage[T, ID]) recordWrite(path string) {
+	sig, _ := metadata.StatSignature(path)
+	d.writtenMu.Lock()
+	d.written[path] = sig
+	d.writtenMu.Unlock()
+}
+
+// ownWrite reports whether the file is still as we last wrote or removed it
+func (d *directoryStorage[T, ID]) ownWrite(path string) bool {
+	sig, _ := metadata.StatSignature(path)
+	d.writtenMu.Lock()
+	defer d.writtenMu.Unlock()
+	written, ok := d.written[path]
+	return ok && written.Equal(sig)
+}
+
+func (d *directoryStorage[T, ID]) Watch(ctx context.Context, onChange func(change storageChange[T])) error {
+	if err := os.MkdirAll(d.baseDir, 0755); err != nil {
+		return err
+	}
+
+	fileChanged := func(key, path string) {
+		if d.ownWrite(path) {
+			return
+		}
+
+		item, err := d.readItem(path)
+		if err != nil {
+			if _, statErr := os.Stat(path); os.IsNotExist(statErr) {
+				onChange(storageChange[T]{removed: []string{key}})
+				return
+			}
+			log.Printf("collection: reloading %s: %v", path, err)
+			return
+		}
+		onChange(storageChange[T]{items: []T{item}})
+	}
+
+	if d.sharder != nil {
+		return pollTree(ctx, d.baseDir, d.ext, fileChanged)
+	}
+	match := func(name string) bool { return filepath.Ext(name) == d.ext }
+	return metadata.WatchFiles(ctx, d.baseDir, match, 0, func(name string) {
+		fileChanged(strings.TrimSuffix(name, d.ext), filepath.Join(d.baseDir, name))
+	})
+}
@@ -0,0 +1,362 @@
+package collection
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+
+	"github.com/mahdi-cpp/api-go-pkg/metadata"
+)
+
+// BoltExtension marks a path as a bolt database for LayoutAuto
+const BoltExtension = ".db"
+
+// boltOpenTimeout bounds the wait for another process holding the database
+var boltOpenTimeout = 5 * time.Second
+
+// boltSchemaBucket records the schema version of each bucket
+var boltSchemaBucket = []byte("$schema")
+
+// openDBs shares one handle per database file, so several collections can
+// use buckets of the same file
+var openDBs = struct {
+	sync.Mutex
+	dbs map[string]*sharedDB
+}{dbs: make(map[string]*sharedDB)}
+
+type sharedDB struct {
+	*bolt.DB
+	refs int
+}
+
+func openBolt(path string) (*sharedDB, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+
+	openDBs.Lock()
+	defer openDBs.Unlock()
+
+	if db, ok := openDBs.dbs[abs]; ok {
+		db.refs++
+		return db, nil
+	}
+	db, err := bolt.Open(abs, 0644, &bolt.Options{Timeout: boltOpenTimeout})
+	if err != nil {
+		return nil, fmt.Errorf("opening %s: %w", path, err)
+	}
+	shared := &sharedDB{DB: db, refs: 1}
+	openDBs.dbs[abs] = shared
+	return shared, nil
+}
+
+func (db *sharedDB) release() error {
+	openDBs.Lock()
+	defer openDBs.Unlock()
+
+	db.refs--
+	if db.refs > 0 {
+		return nil
+	}
+	for path, open := range openDBs.dbs {
+		if open == db {
+			delete(openDBs.dbs, path)
+		}
+	}
+	return db.Close()
+}
+
+// boltStorage keeps each item under its id in one bucket of a bolt
+// database. Integer ids are stored big-endian and string ids as is, so keys
+// sort by id and UUIDv7 keys by creation time. Values are encoded with the
+// configured codec and sealed when WithEncryption is configured. With
+// WithSchemaVersion the bucket is migrated as a whole when it is opened.
+type boltStorage[T Item[ID], ID comparable] struct {
+	path    string
+	db      *sharedDB
+	bucket  []byte
+	codec   metadata.Codec
+	options []metadata.Option
+	schema  int
+
+	closeOnce sync.Once
+}
+
+func newBoltStorage[T Item[ID], ID comparable](path string, cfg config, requireExist bool) (*boltStorage[T, ID], error) {
+	bucket := cfg.bucket
+	if bucket == "" {
+		bucket = strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))
+	}
+
+	// Opening creates the database, so check first
+	if requireExist {
+		if _, err := os.Stat(path); err != nil {
+			return nil, err
+		}
+	}
+	db, err := openBolt(path)
+	if err != nil {
+		return nil, err
+	}
+
+	b := &boltStorage[T, ID]{
+		path:    path,
+		db:      db,
+		bucket:  []byte(bucket),
+		codec:   metadata.ResolveCodec("", cfg.metadata...),
+		options: cfg.metadata,
+		schema:  metadata.SchemaVersion(cfg.metadata...),
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		fresh := tx.Bucket(b.bucket) == nil
+		if fresh && requireExist {
+			return fmt.Errorf("bucket %s of %s: %w", bucket, path, os.ErrNotExist)
+		}
+		if _, err := tx.CreateBucketIfNotExists(b.bucket); err != nil {
+			return err
+		}
+		return b.migrate(tx, fresh)
+	})
+	if err != nil {
+		db.release()
+		return nil, err
+	}
+	return b, nil
+}
+
+// migrate brings the values of the bucket up to the configured schema
+// version. Buckets written before versioning was enabled count as v1.
+func (b *boltStorage[T, ID]) migrate(tx *bolt.Tx, fresh bool) error {
+	if b.schema == 0 {
+		return nil
+	}
+	versions, err := tx.CreateBucketIfNotExists(boltSchemaBucket)
+	if err != nil {
+		return err
+	}
+
+	from := 1
+	if fresh {
+		from = b.schema
+	} else if stored := versions.Get(b.bucket); stored != nil {
+		if from, err = strconv.Atoi(string(stored)); err != nil {
+			return fmt.Errorf("schema version of bucket %s: %w", b.bucket, err)
+		}
+	}
+	if from > b.schema {
+		return fmt.Errorf("bucket %s of %s has schema v%d, newer than supported v%d", b.bucket, b.path, from, b.schema)
+	}
+
+	if from < b.schema {
+		bucket := tx.Bucket(b.bucket)
+		// Values cannot be put while ForEach runs, so collect them first
+		var keys, values [][]byte
+		err := bucket.ForEach(func(key, value []byte) error {
+			value, err := metadata.OpenValue(value, b.options...)
+			if err != nil {
+				return err
+			}
+			name := fmt.Sprintf("%s/%s", b.path, b.bucket)
+			if value, err = metadata.MigrateValue(name, b.codec, value, from, b.options...); err != nil {
+				return err
+			}
+			if value, err = metadata.SealValue(value, b.options...); err != nil {
+				return err
+			}
+			keys = append(keys, slices.Clone(key))
+			values = append(values, value)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for i, key := range keys {
+			if err := bucket.Put(key, values[i]); err != nil {
+				return err
+			}
+		}
+	}
+	return versions.Put(b.bucket, []byte(strconv.Itoa(b.schema)))
+}
+
+func (b *boltStorage[T, ID]) encode(item T) ([]byte, error) {
+	value, err := b.codec.Marshal(item)
+	if err != nil {
+		return nil, err
+	}
+	return metadata.SealValue(value, b.options...)
+}
+
+func (b *boltStorage[T, ID]) decode(value []byte) (T, error) {
+	var item T
+	value, err := metadata.OpenValue(value, b.options...)
+	if err != nil {
+		return item, err
+	}
+	err = b.codec.Unmarshal(value, &item)
+	return item, err
+}
+
+// boltKey encodes a key so that bolt orders it like compareIDs
+func boltKey[ID comparable](key string) []byte {
+	var zero ID
+	switch reflect.TypeOf(zero).Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if n, err := strconv.ParseInt(key, 10, 64); err == nil {
+			return binary.BigEndian.AppendUint64(nil, uint64(n)^1<<63)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if n, err := strconv.ParseUint(key, 10, 64); err == nil {
+			return binary.BigEndian.AppendUint64(nil, n)
+		}
+	}
+	return []byte(key)
+}
+
+// ReadAll reads the bucket; requireExist was checked when it was opened
+func (b *boltStorage[T, ID]) ReadAll(requireExist bool) ([]T, error) {
+	items := []T{}
+	err := b.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(b.bucket).ForEach(func(_, value []byte) error {
+			item, err := b.decode(value)
+			if err != nil {
+				return err
+			}
+			items = append(items, item)
+			return nil
+		})
+	})
+	return items, err
+}
+
+// Apply writes the batch in one bolt transaction
+func (b *boltStorage[T, ID]) Apply(changes []itemChange[T]) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(b.bucket)
+		for _, change := range changes {
+			key := boltKey[ID](change.key)
+			if change.kind == changeDelete {
+				if bucket.Get(key) == nil {
+					return fmt.Errorf("deleting %s: %w", change.key, ErrNotFound)
+				}
+				if err := bucket.Delete(key); err != nil {
+					return err
+				}
+				continue
+			}
+
+			value, err := b.encode(change.item)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(key, value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// scan returns the items with from <= id <= to in key order
+func (b *boltStorage[T, ID]) scan(from, to ID) ([]T, error) {
+	lo, hi := boltKey[ID](keyOf(from)), boltKey[ID](keyOf(to))
+	var items []T
+	err := b.db.View(func(tx *bolt.Tx) error {
+		cursor := tx.Bucket(b.bucket).Cursor()
+		for key, value := cursor.Seek(lo); key != nil && string(key) <= string(hi); key, value = cursor.Next() {
+			item, err := b.decode(value)
+			if err != nil {
+				return err
+			}
+			items = append(items, item)
+		}
+		return nil
+	})
+	return items, err
+}
+
+// Watch returns right away: bbolt locks the file, so no other process can
+// change it while it is open
+func (b *boltStorage[T, ID]) Watch(ctx context.Context, onChange func(change storageChange[T])) error {
+	return nil
+}
+
+func (b *boltStorage[T, ID]) Close() error {
+	var err error
+	b.closeOnce.Do(func() {
+		err = b.db.release()
+	})
+	return err
+}
+
+// Close releases the resources of the storage, such as an open bolt
+// database. Other layouts have nothing to release.
+func (manager *Manager[T, ID]) Close() error {
+	if closer, ok := manager.storage.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
+
+// ScanRange returns the items with from <= id <= to, ordered by id. Bolt
+// collections read the range from disk; other layouts filter the registry.
+func (manager *Manager[T, ID]) ScanRange(from, to ID) ([]T, error) {
+	if b, ok := manager.storage.(*boltStorage[T, ID]); ok {
+		items, err := b.scan(from, to)
+		if err != nil || manager.expiry.Load() == nil {
+			return items, err
+		}
+		now := time.Now()
+		return slices.DeleteFunc(items, func(item T) bool { return manager.expired(item, now) }), nil
+	}
+
+	items, err := manager.GetList(func(item T) bool {
+		return compareIDs(item.GetID(), from) >= 0 && compareIDs(item.GetID(), to) <= 0
+	})
+	if err != nil {
+		return nil, err
+	}
+	return manager.SortItems(items, SortOptions{SortBy: "id", SortOrder: "asc"}), nil
+}
+
+// Import copies the items of the collection at path, in any layout, into
+// this collection in one commit, keeping their ids. It returns how many
+// items were imported.
+func (manager *Manager[T, ID]) Import(path string, options ...Option) (int, error) {
+	cfg := config{}
+	for _, option := range options {
+		option(&cfg)
+	}
+
+	source, err := openStorage[T, ID](path, cfg, true)
+	if err != nil {
+		return 0, err
+	}
+	if closer, ok := source.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	items, err := source.ReadAll(true)
+	if err != nil {
+		return 0, fmt.Errorf("reading %s: %w", path, err)
+	}
+
+	changes := make([]itemChange[T], 0, len(items))
+	for _, item := range items {
+		manager.ids.Observe(item.GetID())
+		changes = append(changes, itemChange[T]{kind: changeCreate, key: keyOf(item.GetID()), item: item})
+	}
+	return len(items), manager.commit(changes)
+}
@@ -0,0 +1,430 @@
+package collection
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mahdi-cpp/api-go-pkg/metadata"
+)
+
+// DefaultCompactThreshold is the number of journal records after which the
+// journal is folded into the snapshot
+var DefaultCompactThreshold = 1000
+
+// journalLockTimeout bounds the wait for another process using the journal
+const journalLockTimeout = 10 * time.Second
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// journalStorage appends every mutation as one record to <path> and keeps
+// the folded state in <path>.snapshot. Records are lines of the form
+// "<crc32c> <json>". Replaying a record twice gives the same state, so a
+// crash between writing the snapshot and truncating the journal is safe.
+// Processes sharing the journal take the lock on <path>.lock; records are
+// encrypted like the snapshot when WithEncryption is configured. Records
+// carry the schema version their items were written with and are migrated
+// on replay.
+type journalStorage[T Item[ID], ID comparable] struct {
+	path      string
+	options   []metadata.Option
+	snapshot  *metadata.Control[[]T]
+	lock      *metadata.FileLock
+	threshold int
+	schema    int
+
+	mu         sync.Mutex
+	records    int
+	compacting atomic.Bool
+	lastWrite  atomic.Pointer[metadata.FileSignature]
+}
+
+type journalOp struct {
+	Op   string          `json:"op"` // put or delete
+	Key  string          `json:"key"`
+	Item json.RawMessage `json:"item,omitempty"`
+}
+
+type journalRecord struct {
+	Schema int         `json:"schema,omitempty"`
+	Ops    []journalOp `json:"ops"`
+}
+
+func newJournalStorage[T Item[ID], ID comparable](path string, options []metadata.Option, threshold int) *journalStorage[T, ID] {
+	if threshold <= 0 {
+		threshold = DefaultCompactThreshold
+	}
+	// Migrations are written per item, apply them to each snapshot element
+	snapshotOptions := append(options[:len(options):len(options)], metadata.WithElementMigrations())
+	return &journalStorage[T, ID]{
+		path:      path,
+		options:   options,
+		snapshot:  metadata.NewMetadataControl[[]T](path+".snapshot", snapshotOptions...),
+		lock:      metadata.NewFileLock(path+".lock", journalLockTimeout),
+		threshold: threshold,
+		schema:    metadata.SchemaVersion(options...),
+	}
+}
+
+// ReadAll loads the collection and cuts off a torn final record. It holds the
+// lock exclusively, so the torn record cannot be another process's append.
+func (j *journalStorage[T, ID]) ReadAll(requireExist bool) ([]T, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	release, err := j.lock.Lock(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	if requireExist {
+		if _, err := os.Stat(j.path); err != nil {
+			if _, snapErr := os.Stat(j.path + ".snapshot"); snapErr != nil {
+				return nil, err
+			}
+		}
+	}
+
+	items, records, err := j.replay(true)
+	if err != nil {
+		return nil, err
+	}
+	j.records = records
+	return items, nil
+}
+
+// reload reads the collection for Watch. It only takes the lock shared and
+// leaves a torn final record alone.
+func (j *journalStorage[T, ID]) reload() ([]T, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	release, err := j.lock.RLock(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	items, _, err := j.replay(false)
+	return items, err
+}
+
+// replay loads the snapshot and applies the journal on top of it. With
+// repair a torn final record is cut off, which needs the exclusive lock.
+func (j *journalStorage[T, ID]) replay(repair bool) ([]T, int, error) {
+	snapshot, err := j.snapshot.Read(false)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	state := newOrderedItems[T]()
+	for _, item := range *snapshot {
+		state.put(keyOf(item.GetID()), item)
+	}
+
+	records, err := j.readJournal(repair, func(record journalRecord) error {
+		for _, op := range record.Ops {
+			switch op.Op {
+			case "put":
+				data, err := j.migrate(record, op.Item)
+				if err != nil {
+					return err
+				}
+				var item T
+				if err := json.Unmarshal(data, &item); err != nil {
+					return fmt.Errorf("%w: %s: %v", metadata.ErrMetadataCorrupted, j.path, err)
+				}
+				state.put(op.Key, item)
+			case "delete":
+				state.delete(op.Key)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+	return state.values(), records, nil
+}
+
+// migrate brings an item of the record up to the configured schema version.
+// Records written before versioning was enabled count as v1.
+func (j *journalStorage[T, ID]) migrate(record journalRecord, data []byte) ([]byte, error) {
+	from := max(record.Schema, 1)
+	if j.schema <= from {
+		return data, nil
+	}
+	return metadata.MigrateValue(j.path, metadata.JSONCodec, data, from, j.options...)
+}
+
+// readJournal calls apply for every intact record. A torn final record,
+// left by a crash during an append, is skipped and with repair cut off;
+// damage before the last record is reported as corruption.
+func (j *journalStorage[T, ID]) readJournal(repair bool, apply func(journalRecord) error) (int, error) {
+	flag := os.O_RDONLY
+	if repair {
+		flag = os.O_RDWR
+	}
+	file, err := os.OpenFile(j.path, flag, 0644)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var offset int64
+	records := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return records, nil
+		}
+		if err != nil && err != io.EOF {
+			return records, err
+		}
+
+		record, ok, err := j.decodeRecord(line)
+		if err != nil {
+			return records, fmt.Errorf("%s: record at offset %d: %w", j.path, offset, err)
+		}
+		if !ok {
+			if rest, _ := reader.Peek(1); len(rest) > 0 {
+				return records, fmt.Errorf("%w: %s: damaged record at offset %d", metadata.ErrMetadataCorrupted, j.path, offset)
+			}
+			if !repair {
+				return records, nil
+			}
+			log.Printf("collection: dropping torn record at the end of %s", j.path)
+			return records, file.Truncate(offset)
+		}
+		if err := apply(record); err != nil {
+			return records, err
+		}
+		offset += int64(len(line))
+		records++
+	}
+}
+
+// decodeRecord reports whether the line is an intact record. An intact
+// record that cannot be decrypted is an error.
+func (j *journalStorage[T, ID]) decodeRecord(line []byte) (journalRecord, bool, error) {
+	var record journalRecord
+	if len(line) < 10 || line[len(line)-1] != '\n' || line[8] != ' ' {
+		return record, false, nil
+	}
+	sum, err := strconv.ParseUint(string(line[:8]), 16, 32)
+	if err != nil {
+		return record, false, nil
+	}
+	body := line[9 : len(line)-1]
+	if crc32.Checksum(body, crcTable) != uint32(sum) {
+		return record, false, nil
+	}
+	body, err = metadata.OpenValue(body, j.options...)
+	if err != nil {
+		return record, false, err
+	}
+	return record, json.Unmarshal(body, &record) == nil, nil
+}
+
+func (j *journalStorage[T, ID]) encodeRecord(record journalRecord) ([]byte, error) {
+	body, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	if body, err = metadata.SealValue(body, j.options...); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%08x ", crc32.Checksum(body, crcTable))
+	buf.Write(body)
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
+
+// appendRecord writes one record with a single write and flushes it to disk
+func (j *journalStorage[T, ID]) appendRecord(record journalRecord) error {
+	line, err := j.encodeRecord(record)
+	if err != nil {
+		return err
+	}
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	release, err := j.lock.Lock(context.Background())
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	if err := os.MkdirAll(filepath.Dir(j.path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(line); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	if sig, err := metadata.StatSignature(j.path); err == nil {
+		j.lastWrite.Store(&sig)
+	}
+	j.records++
+	if j.records >= j.threshold && j.compacting.CompareAndSwap(false, true) {
+		go func() {
+			defer j.compacting.Store(false)
+			if err := j.Compact(); err != nil {
+				log.Printf("collection: compacting %s: %v", j.path, err)
+			}
+		}()
+	}
+	return nil
+}
+
+func putOp[T Item[ID], ID comparable](item T) (journalOp, error) {
+	data, err := json.Marshal(item)
+	if err != nil {
+		return journalOp{}, err
+	}
+	return journalOp{Op: "put", Key: keyOf(item.GetID()), Item: data}, nil
+}
+
+// Apply appends the whole batch as a single record
+func (j *journalStorage[T, ID]) Apply(changes []itemChange[T]) error {
+	record := journalRecord{Schema: j.schema, Ops: make([]journalOp, 0, len(changes))}
+	for _, change := range changes {
+		if change.kind == changeDelete {
+			record.Ops = append(record.Ops, journalOp{Op: "delete", Key: change.key})
+			continue
+		}
+		op, err := putOp[T, ID](change.item)
+		if err != nil {
+			return err
+		}
+		record.Ops = append(record.Ops, op)
+	}
+	return j.appendRecord(record)
+}
+
+// Compact folds the journal into the snapshot and truncates the journal.
+// The exclusive lock keeps other processes from appending in between.
+func (j *journalStorage[T, ID]) Compact() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	release, err := j.lock.Lock(context.Background())
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	items, _, err := j.replay(true)
+	if err != nil {
+		return err
+	}
+	if err := j.snapshot.Write(&items); err != nil {
+		return err
+	}
+	if err := os.Truncate(j.path, 0); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if sig, err := metadata.StatSignature(j.path); err == nil {
+		j.lastWrite.Store(&sig)
+	}
+	j.records = 0
+	return nil
+}
+
+func (j *journalStorage[T, ID]) Watch(ctx context.Context, onChange func(change storageChange[T])) error {
+	base := filepath.Base(j.path)
+	match := func(name string) bool { return name == base }
+	return metadata.WatchFiles(ctx, filepath.Dir(j.path), match, 0, func(string) {
+		sig, _ := metadata.StatSignature(j.path)
+		if written := j.lastWrite.Load(); written != nil && written.Equal(sig) {
+			return
+		}
+		items, err := j.reload()
+		if err != nil {
+			log.Printf("collection: reloading %s: %v", j.path, err)
+			return
+		}
+		onChange(storageChange[T]{items: items, full: true})
+	})
+}
+
+// orderedItems keeps items by key in insertion order
+type orderedItems[T any] struct {
+	index map[string]int
+	items []T
+	live  []bool
+}
+
+func newOrderedItems[T any]() *orderedItems[T] {
+	return &orderedItems[T]{index: make(map[string]int)}
+}
+
+func (o *orderedItems[T]) put(key string, item T) {
+	if i, ok := o.index[key]; ok && o.live[i] {
+		o.items[i] = item
+		return
+	}
+	o.index[key] = len(o.items)
+	o.items = append(o.items, item)
+	o.live = append(o.live, true)
+}
+
+func (o *orderedItems[T]) delete(key string) {
+	if i, ok := o.index[key]; ok {
+		o.live[i] = false
+		delete(o.index, key)
+	}
+}
+
+func (o *orderedItems[T]) values() []T {
+	result := make([]T, 0, len(o.index))
+	for i, item := range o.items {
+		if o.live[i] {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+var errNotJournal = errors.New("storage is not a journal")
+
+// Compact folds the journal into its snapshot right away. It fails for
+// other layouts.
+func (manager *Manager[T, ID]) Compact() error {
+	journal, ok := manager.storage.(*journalStorage[T, ID])
+	if !ok {
+		return errNotJournal
+	}
+	return journal.Compact()
+}
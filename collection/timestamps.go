@@ -0,0 +1,60 @@
+package collection
+
+import "time"
+
+// Models use one of two accessor conventions for their timestamps:
+// SetCreationDate/SetModificationDate (collection_manager) or
+// SetCreatedAt/SetUpdatedAt (collection_manager_uuid7). The Manager accepts
+// both, so existing models work without changes.
+
+type creationDated interface {
+	SetCreationDate(time.Time)
+	SetModificationDate(time.Time)
+	GetCreationDate() time.Time
+	GetModificationDate() time.Time
+}
+
+type createdAtDated interface {
+	SetCreatedAt(time.Time)
+	SetUpdatedAt(time.Time)
+	GetCreatedAt() time.Time
+	GetUpdatedAt() time.Time
+}
+
+func setCreated(item any, t time.Time) {
+	switch v := item.(type) {
+	case creationDated:
+		v.SetCreationDate(t)
+	case createdAtDated:
+		v.SetCreatedAt(t)
+	}
+}
+
+func setModified(item any, t time.Time) {
+	switch v := item.(type) {
+	case creationDated:
+		v.SetModificationDate(t)
+	case createdAtDated:
+		v.SetUpdatedAt(t)
+	}
+}
+
+func createdOf(item any) time.Time {
+	switch v := item.(type) {
+	case creationDated:
+		return v.GetCreationDate()
+	case createdAtDated:
+		return v.GetCreatedAt()
+	}
+	return time.Time{}
+}
+
+func modifiedOf(item any) time.Time {
+	switch v := item.(type) {
+	case creationDated:
+		return v.GetModificationDate()
+	case createdAtDated:
+		return v.GetUpdatedAt()
+	}
+	return time.Time{}
+}
@@ -0,0 +1,273 @@
+package collection
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"time"
+
+	"github.com/mahdi-cpp/api-go-pkg/metadata"
+)
+
+var (
+	ErrTrashDisabled = errors.New("trash is not enabled")
+	ErrExists        = errors.New("item already exists")
+)
+
+// DefaultPurgeInterval is how often StartTrashPurge looks for expired items
+// when no interval is given
+var DefaultPurgeInterval = time.Hour
+
+// TrashedItem is a deleted item kept in the trash
+type TrashedItem[T any] struct {
+	Item      T         `json:"item"`
+	DeletedAt time.Time `json:"deletedAt"`
+}
+
+// trash keeps deleted items in <name>.trash<ext>, next to the collection
+type trash[T Item[ID], ID comparable] struct {
+	ctrl      *metadata.Control[[]TrashedItem[T]]
+	retention time.Duration
+}
+
+func newTrash[T Item[ID], ID comparable](path string, cfg config) *trash[T, ID] {
+	ext := metadata.ResolveCodec("", cfg.metadata...).Extension()
+	trashPath := sidecarPath(path, cfg, "trash", ext)
+	// Migrations are written per item, apply them to the item of each entry
+	options := append(cfg.metadata[:len(cfg.metadata):len(cfg.metadata)], metadata.WithElementFieldMigrations("item"))
+	return &trash[T, ID]{
+		ctrl:      metadata.NewMetadataControl[[]TrashedItem[T]](trashPath, options...),
+		retention: cfg.trashRetention,
+	}
+}
+
+func (t *trash[T, ID]) list() ([]TrashedItem[T], error) {
+	entries, err := t.ctrl.Read(false)
+	if err != nil {
+		return nil, err
+	}
+	return *entries, nil
+}
+
+// update rewrites the trash with the entries fn keeps
+func (t *trash[T, ID]) update(fn func(entries []TrashedItem[T]) ([]TrashedItem[T], error)) error {
+	return t.ctrl.Update(func(entries *[]TrashedItem[T]) error {
+		kept, err := fn(*entries)
+		if err != nil {
+			return err
+		}
+		*entries = kept
+		return nil
+	})
+}
+
+// holds reports whether any of the keys is in the trash
+func (t *trash[T, ID]) holds(keys map[string]bool) bool {
+	if len(keys) == 0 {
+		return false
+	}
+	entries, err := t.list()
+	if err != nil {
+		return true // let update report the error
+	}
+	for _, entry := range entries {
+		if keys[keyOf(entry.Item.GetID())] {
+			return true
+		}
+	}
+	return false
+}
+
+// stageTrash adds the items the changes delete to the trash and takes the
+// items they bring back, e.g. by Restore, Revert or Import, out of it. It
+// returns a function that undoes both. Must be called with mu held.
+func (manager *Manager[T, ID]) stageTrash(changes []itemChange[T]) (func(), error) {
+	if manager.trash == nil {
+		return func() {}, nil
+	}
+
+	// Only the last change to each key decides where the item ends up
+	last := make(map[string]changeKind)
+	for _, change := range changes {
+		_, live := manager.versions[change.key]
+		switch {
+		case change.kind == changeDelete:
+			last[change.key] = changeDelete
+		case !change.fresh && !live:
+			last[change.key] = changeCreate
+		default:
+			delete(last, change.key)
+		}
+	}
+
+	now := time.Now()
+	trashed := make(map[string]bool)
+	var added []TrashedItem[T]
+	for _, change := range changes {
+		if last[change.key] != changeDelete || trashed[change.key] {
+			continue
+		}
+		if item, err := manager.items.Get(change.key); err == nil {
+			trashed[change.key] = true
+			added = append(added, TrashedItem[T]{Item: item, DeletedAt: now})
+		}
+	}
+	restored := make(map[string]bool)
+	for key, kind := range last {
+		if kind == changeCreate {
+			restored[key] = true
+		}
+	}
+	if len(added) == 0 && !manager.trash.holds(restored) {
+		return func() {}, nil
+	}
+
+	var removed []TrashedItem[T]
+	err := manager.trash.update(func(entries []TrashedItem[T]) ([]TrashedItem[T], error) {
+		kept := make([]TrashedItem[T], 0, len(entries)+len(added))
+		for _, entry := range entries {
+			key := keyOf(entry.Item.GetID())
+			if trashed[key] || restored[key] {
+				removed = append(removed, entry)
+				continue
+			}
+			kept = append(kept, entry)
+		}
+		return append(kept, added...), nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("updating trash: %w", err)
+	}
+	return func() {
+		err := manager.trash.update(func(entries []TrashedItem[T]) ([]TrashedItem[T], error) {
+			kept := make([]TrashedItem[T], 0, len(entries)+len(removed))
+			for _, entry := range entries {
+				if !trashed[keyOf(entry.Item.GetID())] {
+					kept = append(kept, entry)
+				}
+			}
+			return append(kept, removed...), nil
+		})
+		if err != nil {
+			log.Printf("collection: undoing trash update: %v", err)
+		}
+	}, nil
+}
+
+// ListTrashed returns the deleted items that have not been purged yet
+func (manager *Manager[T, ID]) ListTrashed() ([]TrashedItem[T], error) {
+	if manager.trash == nil {
+		return nil, ErrTrashDisabled
+	}
+	return manager.trash.list()
+}
+
+// Restore moves a deleted item out of the trash back into the collection
+func (manager *Manager[T, ID]) Restore(id ID) (T, error) {
+	var item T
+	if manager.trash == nil {
+		return item, ErrTrashDisabled
+	}
+
+	key := keyOf(id)
+	_, err := manager.commitBuilt(func() ([]itemChange[T], error) {
+		if _, live := manager.versions[key]; live {
+			return nil, fmt.Errorf("restoring %s: %w", key, ErrExists)
+		}
+		entries, err := manager.trash.list()
+		if err != nil {
+			return nil, err
+		}
+		i := slices.IndexFunc(entries, func(entry TrashedItem[T]) bool {
+			return keyOf(entry.Item.GetID()) == key
+		})
+		if i < 0 {
+			return nil, ErrNotFound
+		}
+		item = entries[i].Item
+		setModified(item, time.Now())
+		// The commit takes the item out of the trash
+		return []itemChange[T]{{kind: changeCreate, key: key, item: item}}, nil
+	})
+	if err != nil {
+		var zero T
+		return zero, err
+	}
+	return item, nil
+}
+
+// Purge removes a deleted item from the trash for good
+func (manager *Manager[T, ID]) Purge(id ID) error {
+	if manager.trash == nil {
+		return ErrTrashDisabled
+	}
+
+	key := keyOf(id)
+	return manager.trash.update(func(entries []TrashedItem[T]) ([]TrashedItem[T], error) {
+		kept := entries[:0]
+		for _, entry := range entries {
+			if keyOf(entry.Item.GetID()) != key {
+				kept = append(kept, entry)
+			}
+		}
+		if len(kept) == len(entries) {
+			return nil, ErrNotFound
+		}
+		return kept, nil
+	})
+}
+
+// PurgeExpired removes the items deleted longer than the retention ago and
+// returns how many were removed
+func (manager *Manager[T, ID]) PurgeExpired() (int, error) {
+	if manager.trash == nil {
+		return 0, ErrTrashDisabled
+	}
+	if manager.trash.retention <= 0 {
+		return 0, nil
+	}
+
+	cutoff := time.Now().Add(-manager.trash.retention)
+	purged := 0
+	err := manager.trash.update(func(entries []TrashedItem[T]) ([]TrashedItem[T], error) {
+		kept := entries[:0]
+		for _, entry := range entries {
+			if entry.DeletedAt.Before(cutoff) {
+				purged++
+				continue
+			}
+			kept = append(kept, entry)
+		}
+		return kept, nil
+	})
+	return purged, err
+}
+
+// StartTrashPurge calls PurgeExpired every interval (DefaultPurgeInterval
+// when zero) in the background until ctx is done
+func (manager *Manager[T, ID]) StartTrashPurge(ctx context.Context, interval time.Duration) error {
+	if manager.trash == nil {
+		return ErrTrashDisabled
+	}
+	if interval <= 0 {
+		interval = DefaultPurgeInterval
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if _, err := manager.PurgeExpired(); err != nil {
+				log.Printf("collection: purging trash: %v", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return nil
+}
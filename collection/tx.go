@@ -0,0 +1,281 @@
+package collection
+
+import (
+	"log"
+	"time"
+)
+
+// Tx collects changes to a Manager and applies them all at once when the
+// function passed to Manager.Tx returns nil
+type Tx[T Item[ID], ID comparable] struct {
+	manager *Manager[T, ID]
+	changes []itemChange[T]
+	actor   string
+}
+
+// SetActor names who makes the changes, for the history
+func (tx *Tx[T, ID]) SetActor(actor string) {
+	tx.actor = actor
+}
+
+// Create sets the timestamps of the item; it is stored on commit. The ids of
+// all items a transaction creates are allocated together once fn returns,
+// so the item has no id inside fn.
+func (tx *Tx[T, ID]) Create(newItem T) (T, error) {
+	setCreated(newItem, time.Now())
+	setModified(newItem, time.Now())
+
+	tx.changes = append(tx.changes, itemChange[T]{kind: changeCreate, item: newItem, fresh: true})
+	return newItem, nil
+}
+
+// assignIDs gives the created items their ids
+func (tx *Tx[T, ID]) assignIDs() error {
+	var created []int
+	for i, change := range tx.changes {
+		if change.fresh {
+			created = append(created, i)
+		}
+	}
+	if len(created) == 0 {
+		return nil
+	}
+
+	ids, err := nextIDs(tx.manager.ids, len(created))
+	if err != nil {
+		return err
+	}
+	for n, i := range created {
+		tx.changes[i].item.SetID(ids[n])
+		tx.changes[i].key = keyOf(ids[n])
+	}
+	return nil
+}
+
+func (tx *Tx[T, ID]) Update(updatedItem T) (T, error) {
+	setModified(updatedItem, time.Now())
+	tx.changes = append(tx.changes, itemChange[T]{kind: changeUpdate, key: keyOf(updatedItem.GetID()), item: updatedItem})
+	return updatedItem, nil
+}
+
+// UpdateIfMatch makes the commit fail with a *ConflictError unless the
+// stored version of the item is expected
+func (tx *Tx[T, ID]) UpdateIfMatch(updatedItem T, expected int64) (T, error) {
+	setModified(updatedItem, time.Now())
+	tx.changes = append(tx.changes, itemChange[T]{
+		kind:         changeUpdate,
+		key:          keyOf(updatedItem.GetID()),
+		item:         updatedItem,
+		checkVersion: true,
+		expected:     expected,
+	})
+	return updatedItem, nil
+}
+
+func (tx *Tx[T, ID]) Delete(id ID) error {
+	tx.changes = append(tx.changes, itemChange[T]{kind: changeDelete, key: keyOf(id)})
+	return nil
+}
+
+// Tx runs fn and applies the changes it made to storage and the registry
+// together, with one write for the single file and journal layouts. Nothing
+// is applied when fn or the write fails.
+func (manager *Manager[T, ID]) Tx(fn func(tx *Tx[T, ID]) error) error {
+	tx := &Tx[T, ID]{manager: manager}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if err := tx.assignIDs(); err != nil {
+		return err
+	}
+	for i := range tx.changes {
+		tx.changes[i].actor = tx.actor
+	}
+	return manager.commit(tx.changes)
+}
+
+func (manager *Manager[T, ID]) CreateMany(newItems []T) ([]T, error) {
+	err := manager.Tx(func(tx *Tx[T, ID]) error {
+		for _, item := range newItems {
+			if _, err := tx.Create(item); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return newItems, err
+}
+
+func (manager *Manager[T, ID]) UpdateMany(updatedItems []T) ([]T, error) {
+	err := manager.Tx(func(tx *Tx[T, ID]) error {
+		for _, item := range updatedItems {
+			tx.Update(item)
+		}
+		return nil
+	})
+	return updatedItems, err
+}
+
+func (manager *Manager[T, ID]) DeleteMany(ids []ID) error {
+	return manager.Tx(func(tx *Tx[T, ID]) error {
+		for _, id := range ids {
+			tx.Delete(id)
+		}
+		return nil
+	})
+}
+
+// commit writes the changes to storage, then to the registry and indexes,
+// and publishes their events
+func (manager *Manager[T, ID]) commit(changes []itemChange[T]) error {
+	if len(changes) == 0 {
+		return nil
+	}
+
+	_, err := manager.commitBuilt(func() ([]itemChange[T], error) { return changes, nil })
+	return err
+}
+
+// commitBuilt commits the changes build returns. build runs with mu held,
+// so it sees the registry as the commit will change it; an error from build
+// cancels the commit. Returns the number of changes.
+func (manager *Manager[T, ID]) commitBuilt(build func() ([]itemChange[T], error)) (int, error) {
+	n, _, err := manager.commitReversible(build)
+	return n, err
+}
+
+// commitReversible is commitBuilt that also returns a function undoing the
+// commit, and what its staged hooks changed elsewhere, with compensating
+// commits. The Manager must be listening for events.
+func (manager *Manager[T, ID]) commitReversible(build func() ([]itemChange[T], error)) (int, func(), error) {
+	manager.mu.Lock()
+	changes, err := build()
+	if err != nil || len(changes) == 0 {
+		manager.mu.Unlock()
+		return 0, func() {}, err
+	}
+	events, steps, err := manager.commitLocked(changes)
+	if err != nil {
+		manager.mu.Unlock()
+		return 0, nil, err
+	}
+	manager.publish(events)
+	return len(changes), func() { manager.revert(events, steps) }, nil
+}
+
+func (manager *Manager[T, ID]) commitLocked(changes []itemChange[T]) ([]Event[T], commitSteps, error) {
+	undoVersions, err := manager.prepareVersions(changes)
+	if err != nil {
+		return nil, nil, err
+	}
+	events := manager.changeEvents(changes)
+	steps, err := manager.vetoed(events)
+	if err != nil {
+		undoVersions()
+		return nil, nil, err
+	}
+	defer steps.finish()
+
+	undoIndexes, err := manager.stageIndexes(changes)
+	if err != nil {
+		undoVersions()
+		return nil, nil, err
+	}
+	undoTrash, err := manager.stageTrash(changes)
+	if err != nil {
+		undoIndexes()
+		undoVersions()
+		return nil, nil, err
+	}
+	if err := steps.apply(); err != nil {
+		undoTrash()
+		undoIndexes()
+		undoVersions()
+		return nil, nil, err
+	}
+	if err := manager.storage.Apply(changes); err != nil {
+		steps.revert()
+		undoTrash()
+		undoIndexes()
+		undoVersions()
+		return nil, nil, err
+	}
+	manager.recordHistory(changes)
+
+	for _, change := range changes {
+		if change.kind == changeDelete {
+			manager.items.Delete(change.key)
+			delete(manager.versions, change.key)
+			manager.forget(change.key)
+		} else {
+			manager.items.Register(change.key, change.item)
+			manager.versions[change.key] = versionOf(change.item)
+			manager.remember(change.key, change.item)
+		}
+	}
+	return events, steps, nil
+}
+
+// revert undoes a commit with the inverse of its events, then the changes
+// its steps made. Must not be called with mu held.
+func (manager *Manager[T, ID]) revert(events []Event[T], steps commitSteps) {
+	changes := make([]itemChange[T], 0, len(events))
+	for i := len(events) - 1; i >= 0; i-- {
+		event := events[i]
+		switch event.Type {
+		case EventCreated:
+			changes = append(changes, itemChange[T]{kind: changeDelete, key: event.Key})
+		case EventDeleted:
+			changes = append(changes, itemChange[T]{kind: changeCreate, key: event.Key, item: event.Before})
+		default:
+			changes = append(changes, itemChange[T]{kind: changeUpdate, key: event.Key, item: event.Before})
+		}
+	}
+	if err := manager.commit(changes); err != nil {
+		log.Printf("collection: undoing a commit: %v", err)
+	}
+	steps.revert()
+}
+
+// commitStep is the part a staged hook plays in a commit. apply runs right
+// before the storage write and an error from it cancels the commit; revert
+// undoes apply when the write fails afterwards; finish runs once the commit
+// is over either way. Each of them may be nil.
+type commitStep struct {
+	apply  func() error
+	revert func()
+	finish func()
+}
+
+type commitSteps []commitStep
+
+// apply runs the steps in order and reverts the applied ones on failure
+func (steps commitSteps) apply() error {
+	for i, step := range steps {
+		if step.apply == nil {
+			continue
+		}
+		if err := step.apply(); err != nil {
+			steps[:i].revert()
+			return err
+		}
+	}
+	return nil
+}
+
+// revert undoes the steps, last first
+func (steps commitSteps) revert() {
+	for i := len(steps) - 1; i >= 0; i-- {
+		if steps[i].revert != nil {
+			steps[i].revert()
+		}
+	}
+}
+
+func (steps commitSteps) finish() {
+	for _, step := range steps {
+		if step.finish != nil {
+			step.finish()
+		}
+	}
+}
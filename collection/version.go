@@ -0,0 +1,151 @@
+package collection
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrConflict    = errors.New("version conflict")
+	ErrInvalidETag = errors.New("invalid etag")
+)
+
+// Versioned items get a version that the Manager increments on every
+// change. Other items use their modification time (in nanoseconds) as
+// version.
+type Versioned interface {
+	GetVersion() int64
+	SetVersion(int64)
+}
+
+// ConflictError reports an update based on an outdated version. It matches
+// ErrConflict with errors.Is.
+type ConflictError struct {
+	Key      string
+	Expected int64
+	Actual   int64
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("version conflict on item %s: expected version %d, stored version is %d", e.Key, e.Expected, e.Actual)
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+func versionOf(item any) int64 {
+	if v, ok := item.(Versioned); ok {
+		return v.GetVersion()
+	}
+	modified := modifiedOf(item)
+	if modified.IsZero() {
+		return 0
+	}
+	return modified.UnixNano()
+}
+
+// ETag formats a version as a strong entity tag, e.g. "42"
+func ETag(version int64) string {
+	return strconv.Quote(strconv.FormatInt(version, 10))
+}
+
+// ParseETag returns the version in an entity tag written by ETag. Weak tags
+// (W/"42") are accepted.
+func ParseETag(tag string) (int64, error) {
+	value := strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+	if len(value) < 2 || value[0] != '"' || value[len(value)-1] != '"' {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidETag, tag)
+	}
+	version, err := strconv.ParseInt(value[1:len(value)-1], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q", ErrInvalidETag, tag)
+	}
+	return version, nil
+}
+
+// Version returns the stored version of an item
+func (manager *Manager[T, ID]) Version(id ID) (int64, error) {
+	manager.mu.RLock()
+	defer manager.mu.RUnlock()
+
+	version, ok := manager.versions[keyOf(id)]
+	if !ok {
+		return 0, ErrNotFound
+	}
+	return version, nil
+}
+
+// UpdateIfMatch updates the item only when its stored version is still
+// expected, and fails with a *ConflictError otherwise. The check covers
+// changes made through this Manager and those picked up by Watch.
+func (manager *Manager[T, ID]) UpdateIfMatch(updatedItem T, expected int64) (T, error) {
+	err := manager.Tx(func(tx *Tx[T, ID]) error {
+		_, err := tx.UpdateIfMatch(updatedItem, expected)
+		return err
+	})
+	return updatedItem, err
+}
+
+// prepareVersions checks the expected versions of the changes and sets the
+// next version on Versioned items, returning a function that resets them.
+// Must be called with mu held.
+func (manager *Manager[T, ID]) prepareVersions(changes []itemChange[T]) (func(), error) {
+	type previous struct {
+		item    Versioned
+		version int64
+	}
+	var set []previous
+	undo := func() {
+		for i := len(set) - 1; i >= 0; i-- {
+			set[i].item.SetVersion(set[i].version)
+		}
+	}
+
+	// Versions as of the previous changes in the batch
+	current := make(map[string]int64)
+	deleted := make(map[string]bool)
+	versionOfKey := func(key string) (int64, bool) {
+		if deleted[key] {
+			return 0, false
+		}
+		if version, ok := current[key]; ok {
+			return version, true
+		}
+		version, ok := manager.versions[key]
+		return version, ok
+	}
+
+	for _, change := range changes {
+		stored, exists := versionOfKey(change.key)
+		if change.checkVersion {
+			if !exists {
+				undo()
+				return nil, ErrNotFound
+			}
+			if stored != change.expected {
+				undo()
+				return nil, &ConflictError{Key: change.key, Expected: change.expected, Actual: stored}
+			}
+		}
+
+		if change.kind == changeDelete {
+			deleted[change.key] = true
+			delete(current, change.key)
+			continue
+		}
+		delete(deleted, change.key)
+		if v, ok := any(change.item).(Versioned); ok {
+			set = append(set, previous{v, v.GetVersion()})
+			// New and restored items continue from the version they carry
+			if change.kind == changeCreate || !exists {
+				stored = v.GetVersion()
+			}
+			v.SetVersion(stored + 1)
+		}
+		current[change.key] = versionOf(change.item)
+	}
+	return undo, nil
+}
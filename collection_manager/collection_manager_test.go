@@ -0,0 +1,119 @@
+package collection_manager
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/mahdi-cpp/api-go-pkg/test_model"
+)
+
+func TestConcurrentCreateDeleteNeverReusesIDs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "messages")
+	manager, err := NewCollectionManager[*test_model.Message](path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const workers, perWorker = 8, 25
+	var (
+		mu   sync.Mutex
+		seen = make(map[int]bool)
+		wg   sync.WaitGroup
+	)
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range perWorker {
+				message, err := manager.Create(&test_model.Message{Content: "hello"})
+				if err != nil {
+					t.Error(err)
+					return
+				}
+
+				mu.Lock()
+				if seen[message.ID] {
+					t.Errorf("id %d handed out twice", message.ID)
+				}
+				seen[message.ID] = true
+				mu.Unlock()
+
+				if i%2 == 0 {
+					if err := manager.Delete(message.ID); err != nil {
+						t.Error(err)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(seen) != workers*perWorker {
+		t.Fatalf("got %d ids, want %d", len(seen), workers*perWorker)
+	}
+	highest := 0
+	for id := range seen {
+		highest = max(highest, id)
+	}
+
+	// Another manager on the same collection continues after every id
+	// handed out, including the deleted ones
+	reopened, err := NewCollectionManager[*test_model.Message](path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := reopened.Create(&test_model.Message{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.ID <= highest || seen[message.ID] {
+		t.Fatalf("new id %d, want above %d", message.ID, highest)
+	}
+}
+
+func TestSequenceSurvivesDeletingHighestID(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "messages")
+	manager, err := NewCollectionManager[*test_model.Message](path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	created, err := manager.CreateMany([]*test_model.Message{{}, {}, {}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	highest := created[2].ID
+	if err := manager.Delete(highest); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, "messages.seq.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sequence struct {
+		Last int `json:"last"`
+	}
+	if err := json.Unmarshal(data, &sequence); err != nil {
+		t.Fatal(err)
+	}
+	if sequence.Last != highest {
+		t.Fatalf("sequence file has last %d, want %d", sequence.Last, highest)
+	}
+
+	reopened, err := NewCollectionManager[*test_model.Message](path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := reopened.Create(&test_model.Message{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if message.ID != highest+1 {
+		t.Fatalf("new id %d, want %d", message.ID, highest+1)
+	}
+}
@@ -6,8 +6,15 @@ require (
 	github.com/disintegration/imaging v1.6.3-0.20200122095911-d8633a436aab
 	github.com/dsoprea/go-exif v0.0.0-20230826092837-6579e82b732d
 	github.com/dsoprea/go-exif/v3 v3.0.1
+	github.com/evanphx/json-patch v5.9.11+incompatible
+	github.com/fsnotify/fsnotify v1.9.0
+	github.com/fxamacker/cbor/v2 v2.9.2
 	github.com/google/uuid v1.6.0
 	github.com/hashicorp/golang-lru/v2 v2.0.7
+	github.com/oklog/ulid/v2 v2.1.1
+	github.com/vmihailenco/msgpack/v5 v5.4.1
+	go.etcd.io/bbolt v1.4.3
+	golang.org/x/sys v0.31.0
 )
 
 require (
@@ -17,6 +24,8 @@ require (
 	github.com/golang/geo v0.0.0-20210211234256-740aa86cb551 // indirect
 	github.com/kr/pretty v0.3.1 // indirect
 	github.com/rogpeppe/go-internal v1.13.1 // indirect
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	github.com/x448/float16 v0.8.4 // indirect
 	golang.org/x/image v0.20.0 // indirect
 	golang.org/x/net v0.38.0 // indirect
 	gopkg.in/check.v1 v1.0.0-20201130134442-10cb98267c6c // indirect
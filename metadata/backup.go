@@ -0,0 +1,238 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// snapshotLayout names timestamped snapshots so they sort chronologically
+const snapshotLayout = "20060102T150405.000000000Z"
+
+// Backup is a previous version of the file
+type Backup struct {
+	Version string
+	Path    string
+	ModTime time.Time
+	Size    int64
+}
+
+// WithBackups keeps the previous `count` versions of the file as
+// <file>.bak.1 (newest) up to <file>.bak.<count>
+func WithBackups(count int) Option {
+	return func(o *options) {
+		o.backups = count
+	}
+}
+
+// WithSnapshots keeps a timestamped copy <file>.bak.<time> of every previous
+// version. Snapshots beyond the newest `keep` or older than maxAge are
+// deleted; zero disables either limit.
+func WithSnapshots(keep int, maxAge time.Duration) Option {
+	return func(o *options) {
+		o.snapshots = true
+		o.snapshotKeep = keep
+		o.snapshotMaxAge = maxAge
+	}
+}
+
+func (control *Control[T]) backupPath(version string) string {
+	return control.filePath + ".bak." + version
+}
+
+// backup preserves the current file before it is replaced
+func (control *Control[T]) backup() error {
+	if control.options.backups <= 0 && !control.options.snapshots {
+		return nil
+	}
+	if _, err := os.Stat(control.filePath); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	if control.options.snapshots {
+		version := time.Now().UTC().Format(snapshotLayout)
+		if err := linkOrCopy(control.filePath, control.backupPath(version)); err != nil {
+			return err
+		}
+		return control.pruneSnapshots()
+	}
+
+	// Rotate .bak.N-1 -> .bak.N ... .bak.1 -> .bak.2
+	for i := control.options.backups - 1; i >= 1; i-- {
+		from := control.backupPath(strconv.Itoa(i))
+		if _, err := os.Stat(from); err == nil {
+			if err := os.Rename(from, control.backupPath(strconv.Itoa(i+1))); err != nil {
+				return err
+			}
+		}
+	}
+	first := control.backupPath("1")
+	_ = os.Remove(first)
+	return linkOrCopy(control.filePath, first)
+}
+
+func (control *Control[T]) pruneSnapshots() error {
+	backups, err := control.listBackups()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	kept := 0
+	for _, backup := range backups {
+		taken, err := time.Parse(snapshotLayout, backup.Version)
+		if err != nil {
+			continue // not a snapshot
+		}
+		kept++
+		tooMany := control.options.snapshotKeep > 0 && kept > control.options.snapshotKeep
+		tooOld := control.options.snapshotMaxAge > 0 && now.Sub(taken) > control.options.snapshotMaxAge
+		if tooMany || tooOld {
+			if err := os.Remove(backup.Path); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ListBackups returns the backups and snapshots of the file, newest first
+func (control *Control[T]) ListBackups() ([]Backup, error) {
+	control.mutex.RLock()
+	defer control.mutex.RUnlock()
+	return control.listBackups()
+}
+
+func (control *Control[T]) listBackups() ([]Backup, error) {
+	prefix := filepath.Base(control.filePath) + ".bak."
+	entries, err := os.ReadDir(filepath.Dir(control.filePath))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var backups []Backup
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasPrefix(entry.Name(), prefix) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			continue
+		}
+		backups = append(backups, Backup{
+			Version: strings.TrimPrefix(entry.Name(), prefix),
+			Path:    filepath.Join(filepath.Dir(control.filePath), entry.Name()),
+			ModTime: info.ModTime(),
+			Size:    info.Size(),
+		})
+	}
+
+	sort.Slice(backups, func(i, j int) bool {
+		return backupNewer(backups[i], backups[j])
+	})
+	return backups, nil
+}
+
+// backupNewer orders rotated backups by number and snapshots by time
+func backupNewer(a, b Backup) bool {
+	an, aErr := strconv.Atoi(a.Version)
+	bn, bErr := strconv.Atoi(b.Version)
+	if aErr == nil && bErr == nil {
+		return an < bn
+	}
+	return a.Version > b.Version
+}
+
+// ReadBackup decodes a backup. The empty version reads the current file.
+func (control *Control[T]) ReadBackup(version string) (*T, error) {
+	control.mutex.RLock()
+	defer control.mutex.RUnlock()
+	return control.readVersion(version)
+}
+
+func (control *Control[T]) readVersion(version string) (*T, error) {
+	path := control.filePath
+	if version != "" {
+		path = control.backupPath(version)
+	}
+	file, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) && version != "" {
+			return nil, fmt.Errorf("backup %s of %s does not exist", version, control.filePath)
+		}
+		return nil, err
+	}
+	data, _, err := control.decode(file)
+	return data, err
+}
+
+// Restore replaces the file with a backup. The current file is backed up
+// first, so a restore can itself be undone.
+func (control *Control[T]) Restore(ctx context.Context, version string) error {
+	control.mutex.Lock()
+	defer control.mutex.Unlock()
+
+	release, err := control.lockFile(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	data, err := control.readVersion(version)
+	if err != nil {
+		return err
+	}
+	return control.writeData(data)
+}
+
+// DiffBackups lists the field-level changes between two versions of the
+// document. The empty version stands for the current file.
+func (control *Control[T]) DiffBackups(from, to string) ([]Change, error) {
+	control.mutex.RLock()
+	defer control.mutex.RUnlock()
+
+	before, err := control.readVersion(from)
+	if err != nil {
+		return nil, err
+	}
+	after, err := control.readVersion(to)
+	if err != nil {
+		return nil, err
+	}
+	return DiffValues(before, after)
+}
+
+// linkOrCopy hard links src to dst, copying when links are not supported
+func linkOrCopy(src, dst string) error {
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,144 @@
+package metadata
+
+import (
+	"reflect"
+	"sync"
+	"sync/atomic"
+)
+
+// WithCache keeps the decoded value in memory and only reparses the file
+// when its mtime, size or inode changes. Callers get deep copies, so they
+// cannot modify the cached value.
+func WithCache() Option {
+	return func(o *options) {
+		o.cache = true
+	}
+}
+
+// CacheStats counts cache lookups of a Control
+type CacheStats struct {
+	Hits   uint64
+	Misses uint64
+}
+
+type valueCache[T any] struct {
+	mu     sync.Mutex
+	value  *T
+	sig    FileSignature
+	hits   atomic.Uint64
+	misses atomic.Uint64
+}
+
+func (c *valueCache[T]) get(sig FileSignature) (*T, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.value == nil || !c.sig.Equal(sig) {
+		c.misses.Add(1)
+		return nil, false
+	}
+	c.hits.Add(1)
+	return deepCopy(c.value), true
+}
+
+func (c *valueCache[T]) put(sig FileSignature, value *T) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.value = deepCopy(value)
+	c.sig = sig
+}
+
+func (c *valueCache[T]) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.value = nil
+}
+
+// CacheStats returns the hit and miss counters of the read cache
+func (control *Control[T]) CacheStats() CacheStats {
+	return CacheStats{
+		Hits:   control.cache.hits.Load(),
+		Misses: control.cache.misses.Load(),
+	}
+}
+
+// readCached is readData served from the cache when the file is unchanged
+func (control *Control[T]) readCached(requireExist bool) (*T, bool, error) {
+	if !control.options.cache {
+		return control.readData(requireExist)
+	}
+
+	sig, err := StatSignature(control.filePath)
+	if err != nil {
+		return control.readData(requireExist)
+	}
+	if data, ok := control.cache.get(sig); ok {
+		return data, false, nil
+	}
+
+	data, stale, err := control.readData(requireExist)
+	if err == nil && !stale {
+		control.cache.put(sig, data)
+	}
+	return data, stale, err
+}
+
+// deepCopy copies value through reflection. Unexported fields are copied
+// shallowly and cyclic values are not supported.
+func deepCopy[T any](value *T) *T {
+	return copyValue(reflect.ValueOf(value)).Interface().(*T)
+}
+
+func copyValue(v reflect.Value) reflect.Value {
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			return v
+		}
+		n := reflect.New(v.Type().Elem())
+		n.Elem().Set(copyValue(v.Elem()))
+		return n
+	case reflect.Interface:
+		if v.IsNil() {
+			return v
+		}
+		n := reflect.New(v.Type()).Elem()
+		n.Set(copyValue(v.Elem()))
+		return n
+	case reflect.Slice:
+		if v.IsNil() {
+			return v
+		}
+		n := reflect.MakeSlice(v.Type(), v.Len(), v.Len())
+		for i := 0; i < v.Len(); i++ {
+			n.Index(i).Set(copyValue(v.Index(i)))
+		}
+		return n
+	case reflect.Array:
+		n := reflect.New(v.Type()).Elem()
+		for i := 0; i < v.Len(); i++ {
+			n.Index(i).Set(copyValue(v.Index(i)))
+		}
+		return n
+	case reflect.Map:
+		if v.IsNil() {
+			return v
+		}
+		n := reflect.MakeMapWithSize(v.Type(), v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			n.SetMapIndex(iter.Key(), copyValue(iter.Value()))
+		}
+		return n
+	case reflect.Struct:
+		n := reflect.New(v.Type()).Elem()
+		n.Set(v)
+		for i := 0; i < v.NumField(); i++ {
+			if n.Field(i).CanSet() {
+				n.Field(i).Set(copyValue(v.Field(i)))
+			}
+		}
+		return n
+	default:
+		return v
+	}
+}
@@ -0,0 +1,120 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// Codec serializes the value managed by a Control
+type Codec interface {
+	Name() string
+	Extension() string
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+var (
+	JSONCodec        Codec = jsonCodec{}
+	GobCodec         Codec = gobCodec{}
+	CBORCodec        Codec = cborCodec{}
+	MessagePackCodec Codec = msgpackCodec{}
+)
+
+var codecs = []Codec{JSONCodec, GobCodec, CBORCodec, MessagePackCodec}
+
+// CodecByName returns the built-in codec with the given name
+func CodecByName(name string) (Codec, bool) {
+	for _, codec := range codecs {
+		if codec.Name() == name {
+			return codec, true
+		}
+	}
+	return nil, false
+}
+
+// CodecForPath detects the codec from the file extension
+func CodecForPath(path string) (Codec, bool) {
+	ext := strings.ToLower(filepath.Ext(path))
+	for _, codec := range codecs {
+		if codec.Extension() == ext {
+			return codec, true
+		}
+	}
+	return nil, false
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string      { return "json" }
+func (jsonCodec) Extension() string { return ".json" }
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.MarshalIndent(v, "", "  ")
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Name() string      { return "gob" }
+func (gobCodec) Extension() string { return ".gob" }
+
+func (gobCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte, v any) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// cborDecMode decodes maps into map[string]any so generic values look like JSON
+var cborDecMode, _ = cbor.DecOptions{
+	DefaultMapType: reflect.TypeOf(map[string]any(nil)),
+}.DecMode()
+
+type cborCodec struct{}
+
+func (cborCodec) Name() string      { return "cbor" }
+func (cborCodec) Extension() string { return ".cbor" }
+
+func (cborCodec) Marshal(v any) ([]byte, error) {
+	return cbor.Marshal(v)
+}
+
+func (cborCodec) Unmarshal(data []byte, v any) error {
+	return cborDecMode.Unmarshal(data, v)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string      { return "msgpack" }
+func (msgpackCodec) Extension() string { return ".msgpack" }
+
+func (msgpackCodec) Marshal(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	encoder := msgpack.NewEncoder(&buf)
+	encoder.SetCustomStructTag("json")
+	if err := encoder.Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v any) error {
+	decoder := msgpack.NewDecoder(bytes.NewReader(data))
+	decoder.SetCustomStructTag("json")
+	return decoder.Decode(v)
+}
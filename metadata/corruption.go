@@ -0,0 +1,124 @@
+package metadata
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+)
+
+var ErrMetadataCorrupted = errors.New("metadata corrupted")
+
+// WithChecksum stores a SHA-256 checksum of the payload in the file header,
+// so truncated or damaged files are reported as ErrMetadataCorrupted
+// instead of decoding into wrong data
+func WithChecksum() Option {
+	return func(o *options) {
+		o.checksum = true
+	}
+}
+
+// WithAutoRecover makes Read and Update replace a corrupted file with the
+// newest valid .tmp file or backup instead of failing
+func WithAutoRecover() Option {
+	return func(o *options) {
+		o.autoRecover = true
+	}
+}
+
+func checksum(payload []byte) string {
+	sum := sha256.Sum256(payload)
+	return formatChecksum(sum[:])
+}
+
+func formatChecksum(sum []byte) string {
+	return "sha256:" + hex.EncodeToString(sum)
+}
+
+func corrupted(path string, err error) error {
+	return fmt.Errorf("%w: %s: %v", ErrMetadataCorrupted, path, err)
+}
+
+// Verify checks that the file decodes and matches its checksum. A missing
+// file is valid.
+func (control *Control[T]) Verify() error {
+	control.mutex.RLock()
+	defer control.mutex.RUnlock()
+
+	_, _, err := control.readData(false)
+	return err
+}
+
+// Recover replaces a corrupted file with the newest valid .tmp file or
+// backup and returns the path it recovered from. A valid file is left
+// alone and the empty path is returned.
+func (control *Control[T]) Recover(ctx context.Context) (string, error) {
+	control.mutex.Lock()
+	defer control.mutex.Unlock()
+
+	release, err := control.lockFile(ctx, true)
+	if err != nil {
+		return "", err
+	}
+	defer release()
+
+	if _, _, err := control.readData(false); !errors.Is(err, ErrMetadataCorrupted) {
+		return "", err
+	}
+	_, source, err := control.recoverData()
+	return source, err
+}
+
+// recoverData must be called with the write lock held
+func (control *Control[T]) recoverData() (*T, string, error) {
+	for _, path := range control.recoveryCandidates() {
+		file, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		data, _, err := control.decode(file)
+		if err != nil {
+			continue
+		}
+
+		// Keep the damaged file for inspection; it must not become a backup
+		if err := os.Rename(control.filePath, control.filePath+".corrupt"); err != nil && !os.IsNotExist(err) {
+			return nil, "", err
+		}
+		if err := control.writeData(data); err != nil {
+			return nil, "", err
+		}
+		return data, path, nil
+	}
+	return nil, "", fmt.Errorf("%w: no valid .tmp file or backup to recover %s from", ErrMetadataCorrupted, control.filePath)
+}
+
+// recoveryCandidates lists the leftover .tmp file and the backups, newest first
+func (control *Control[T]) recoveryCandidates() []string {
+	type candidate struct {
+		path    string
+		modTime int64
+	}
+
+	var candidates []candidate
+	if info, err := os.Stat(control.filePath + ".tmp"); err == nil {
+		candidates = append(candidates, candidate{control.filePath + ".tmp", info.ModTime().UnixNano()})
+	}
+	backups, _ := control.listBackups()
+	for _, backup := range backups {
+		candidates = append(candidates, candidate{backup.Path, backup.ModTime.UnixNano()})
+	}
+
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].modTime > candidates[j].modTime
+	})
+
+	paths := make([]string, len(candidates))
+	for i, c := range candidates {
+		paths[i] = c.path
+	}
+	return paths
+}
@@ -0,0 +1,123 @@
+package metadata
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// Change is a single difference between two documents. Path is a JSON
+// pointer (RFC 6901) to the changed value.
+type Change struct {
+	Path   string `json:"path"`
+	Before any    `json:"before,omitempty"`
+	After  any    `json:"after,omitempty"`
+}
+
+// Diff compares two generic documents (maps, slices and scalars)
+func Diff(before, after any) []Change {
+	var changes []Change
+	diffValue("", before, after, &changes)
+	return changes
+}
+
+// DiffValues compares two values through their JSON form, so field names
+// follow the json tags
+func DiffValues(before, after any) ([]Change, error) {
+	a, err := toGeneric(before)
+	if err != nil {
+		return nil, err
+	}
+	b, err := toGeneric(after)
+	if err != nil {
+		return nil, err
+	}
+	return Diff(a, b), nil
+}
+
+func toGeneric(value any) (any, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var doc any
+	if err := json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func diffValue(path string, before, after any, changes *[]Change) {
+	switch a := before.(type) {
+	case map[string]any:
+		if b, ok := after.(map[string]any); ok {
+			keys := make(map[string]bool, len(a)+len(b))
+			for k := range a {
+				keys[k] = true
+			}
+			for k := range b {
+				keys[k] = true
+			}
+			sorted := make([]string, 0, len(keys))
+			for k := range keys {
+				sorted = append(sorted, k)
+			}
+			sort.Strings(sorted)
+
+			for _, k := range sorted {
+				va, inA := a[k]
+				vb, inB := b[k]
+				child := path + "/" + escapePointer(k)
+				switch {
+				case !inA:
+					*changes = append(*changes, Change{Path: child, After: vb})
+				case !inB:
+					*changes = append(*changes, Change{Path: child, Before: va})
+				default:
+					diffValue(child, va, vb, changes)
+				}
+			}
+			return
+		}
+	case []any:
+		if b, ok := after.([]any); ok {
+			for i := 0; i < len(a) || i < len(b); i++ {
+				child := path + "/" + strconv.Itoa(i)
+				switch {
+				case i >= len(a):
+					*changes = append(*changes, Change{Path: child, After: b[i]})
+				case i >= len(b):
+					*changes = append(*changes, Change{Path: child, Before: a[i]})
+				default:
+					diffValue(child, a[i], b[i], changes)
+				}
+			}
+			return
+		}
+	}
+
+	if !reflect.DeepEqual(before, after) {
+		*changes = append(*changes, Change{Path: path, Before: before, After: after})
+	}
+}
+
+func escapePointer(key string) string {
+	out := make([]byte, 0, len(key))
+	for i := 0; i < len(key); i++ {
+		switch key[i] {
+		case '~':
+			out = append(out, '~', '0')
+		case '/':
+			out = append(out, '~', '1')
+		default:
+			out = append(out, key[i])
+		}
+	}
+	return string(out)
+}
+
+func (c Change) String() string {
+	return fmt.Sprintf("%s: %v -> %v", c.Path, c.Before, c.After)
+}
@@ -0,0 +1,198 @@
+package metadata
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+var (
+	ErrNoKeyProvider = errors.New("file is encrypted but no key provider is configured")
+	ErrWrongKey      = errors.New("data key cannot be unwrapped with the configured key")
+)
+
+// errAuthentication means the ciphertext was modified or truncated
+var errAuthentication = errors.New("ciphertext authentication failed")
+
+// KeyProvider supplies the 32 byte AES-256 key-encryption keys. Each file
+// is encrypted with its own random data key, which is stored wrapped by the
+// provider key next to the key id in the file header.
+type KeyProvider interface {
+	// CurrentKey returns the key new writes are encrypted with
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns the key with the given id, for files written before a rotation
+	Key(id string) ([]byte, error)
+}
+
+// WithEncryption encrypts the file with AES-256-GCM. Plain files and files
+// encrypted with an older key stay readable and are rewritten with the
+// current key the next time they are read. A provider serving the wrong key
+// makes reads fail with ErrWrongKey, which WithAutoRecover leaves alone.
+func WithEncryption(provider KeyProvider) Option {
+	return func(o *options) {
+		o.keys = provider
+	}
+}
+
+// StaticKeyProvider serves keys from memory
+type StaticKeyProvider struct {
+	current string
+	keys    map[string][]byte
+}
+
+func NewStaticKeyProvider(current string, keys map[string][]byte) (*StaticKeyProvider, error) {
+	for id, key := range keys {
+		if len(key) != 32 {
+			return nil, fmt.Errorf("key %q must be 32 bytes, got %d", id, len(key))
+		}
+	}
+	if _, ok := keys[current]; !ok {
+		return nil, fmt.Errorf("current key %q is not in the key set", current)
+	}
+	return &StaticKeyProvider{current: current, keys: keys}, nil
+}
+
+func (p *StaticKeyProvider) CurrentKey() (string, []byte, error) {
+	return p.current, p.keys[p.current], nil
+}
+
+func (p *StaticKeyProvider) Key(id string) ([]byte, error) {
+	key, ok := p.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("unknown key %q", id)
+	}
+	return key, nil
+}
+
+// SealValue encrypts data with the key provider configured in opts, for
+// values kept outside a Control such as journal records or database values.
+// The result is a single line of JSON. Without WithEncryption data is
+// returned as is.
+func SealValue(data []byte, opts ...Option) ([]byte, error) {
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.keys == nil {
+		return data, nil
+	}
+
+	env := &envelope{}
+	sealed, err := encrypt(o.keys, env, data)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := json.Marshal(sealed)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(jsonEnvelope{Metadata: env, Data: payload})
+}
+
+// OpenValue returns the data of a value written by SealValue. Values that
+// were stored unencrypted are returned as is.
+func OpenValue(data []byte, opts ...Option) ([]byte, error) {
+	if !bytes.HasPrefix(data, []byte(jsonEnvelopePrefix)) {
+		return data, nil
+	}
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	env, payload, err := parseJSONEnvelope(data)
+	if err != nil {
+		return nil, err
+	}
+	if !env.encrypted() {
+		return payload, nil
+	}
+	return decrypt(o.keys, env, payload)
+}
+
+// encrypt seals payload with a fresh data key and records the wrapped data
+// key in env
+func encrypt(provider KeyProvider, env *envelope, payload []byte) ([]byte, error) {
+	keyID, kek, err := provider.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+
+	dataKey := make([]byte, 32)
+	if _, err := rand.Read(dataKey); err != nil {
+		return nil, err
+	}
+
+	wrapped, err := seal(kek, dataKey)
+	if err != nil {
+		return nil, err
+	}
+	sealed, err := seal(dataKey, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	env.KeyID = keyID
+	env.DataKey = wrapped
+	return sealed, nil
+}
+
+// decrypt opens a payload written by encrypt
+func decrypt(provider KeyProvider, env *envelope, payload []byte) ([]byte, error) {
+	if provider == nil {
+		return nil, ErrNoKeyProvider
+	}
+
+	kek, err := provider.Key(env.KeyID)
+	if err != nil {
+		return nil, err
+	}
+	// A data key that does not open means the provider serves the wrong
+	// key, not that the file is damaged
+	dataKey, err := unseal(kek, env.DataKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w %q", ErrWrongKey, env.KeyID)
+	}
+	return unseal(dataKey, payload)
+}
+
+// seal encrypts with AES-GCM and prefixes the random nonce
+func seal(key, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func unseal(key, sealed []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errAuthentication
+	}
+	nonce, ciphertext := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, errAuthentication
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,127 @@
+package metadata
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"slices"
+)
+
+// envelopeMagic starts the header line in front of the payload of binary
+// codecs
+const envelopeMagic = "#!metadata "
+
+// jsonEnvelopePrefix starts JSON files that carry an envelope. They stay
+// valid JSON: {"$metadata":{...},"data":<payload>}, with the payload as a
+// base64 string when it is encrypted.
+const jsonEnvelopePrefix = `{"$metadata":`
+
+// envelope describes how the payload of a file is stored
+type envelope struct {
+	Codec  string `json:"codec,omitempty"` // empty for values sealed with SealValue
+	Schema int    `json:"schema,omitempty"`
+
+	// Encryption: the id of the key that wraps DataKey
+	KeyID   string `json:"keyId,omitempty"`
+	DataKey []byte `json:"dataKey,omitempty"`
+
+	// Sum is the checksum of the stored payload
+	Sum string `json:"sum,omitempty"`
+}
+
+// plain reports whether the envelope carries nothing a plain JSON file
+// could not express
+func (env *envelope) plain() bool {
+	return env.Codec == JSONCodec.Name() && env.Schema == 0 && env.KeyID == "" && env.Sum == ""
+}
+
+func (env *envelope) encrypted() bool {
+	return env != nil && env.KeyID != ""
+}
+
+// schemaVersion returns the stored schema version. Files written before
+// versioning was enabled count as v1.
+func (env *envelope) schemaVersion() int {
+	if env == nil || env.Schema == 0 {
+		return 1
+	}
+	return env.Schema
+}
+
+// jsonEnvelope is the layout of JSON files that carry an envelope
+type jsonEnvelope struct {
+	Metadata *envelope       `json:"$metadata"`
+	Data     json.RawMessage `json:"data"`
+}
+
+// parseEnvelope splits a file into its envelope and payload. Plain files
+// without an envelope return a nil envelope and the whole content as payload.
+func parseEnvelope(content []byte) (*envelope, []byte, error) {
+	if bytes.HasPrefix(content, []byte(jsonEnvelopePrefix)) {
+		return parseJSONEnvelope(content)
+	}
+	if !bytes.HasPrefix(content, []byte(envelopeMagic)) {
+		return nil, content, nil
+	}
+
+	end := bytes.IndexByte(content, '\n')
+	if end < 0 {
+		return nil, nil, fmt.Errorf("metadata header is not terminated")
+	}
+
+	env := &envelope{}
+	if err := json.Unmarshal(content[len(envelopeMagic):end], env); err != nil {
+		return nil, nil, fmt.Errorf("invalid metadata header: %w", err)
+	}
+	return env, content[end+1:], nil
+}
+
+func parseJSONEnvelope(content []byte) (*envelope, []byte, error) {
+	var file jsonEnvelope
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, nil, fmt.Errorf("invalid metadata envelope: %w", err)
+	}
+	if file.Metadata == nil {
+		return nil, nil, fmt.Errorf("metadata envelope has no $metadata")
+	}
+	if !file.Metadata.encrypted() {
+		return file.Metadata, file.Data, nil
+	}
+	var payload []byte
+	if err := json.Unmarshal(file.Data, &payload); err != nil {
+		return nil, nil, fmt.Errorf("invalid encrypted payload: %w", err)
+	}
+	return file.Metadata, payload, nil
+}
+
+func writeEnvelope(env *envelope, payload []byte) ([]byte, error) {
+	header, err := json.Marshal(env)
+	if err != nil {
+		return nil, err
+	}
+
+	if env.Codec == JSONCodec.Name() {
+		if env.encrypted() {
+			if payload, err = json.Marshal(payload); err != nil {
+				return nil, err
+			}
+		}
+		open, closing := jsonEnvelopeParts(header)
+		return slices.Concat(open, payload, closing), nil
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(envelopeMagic) + len(header) + 1 + len(payload))
+	buf.WriteString(envelopeMagic)
+	buf.Write(header)
+	buf.WriteByte('\n')
+	buf.Write(payload)
+	return buf.Bytes(), nil
+}
+
+// jsonEnvelopeParts returns what goes before and after the payload in a
+// JSON file with the given envelope header
+func jsonEnvelopeParts(header []byte) ([]byte, []byte) {
+	open := slices.Concat([]byte(jsonEnvelopePrefix), header, []byte(`,"data":`))
+	return open, []byte("}")
+}
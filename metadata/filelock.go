@@ -0,0 +1,83 @@
+package metadata
+
+import (
+	"context"
+	"errors"
+	"os"
+	"time"
+)
+
+var (
+	ErrLockTimeout     = errors.New("timed out waiting for file lock")
+	ErrLockUnsupported = errors.New("file locks are not supported")
+)
+
+// lockRetryInterval is how often a busy lock is retried
+const lockRetryInterval = 10 * time.Millisecond
+
+// FileLock is an advisory lock shared between processes. The lock is taken
+// on a sidecar file because the data file itself is replaced on every write.
+type FileLock struct {
+	path    string
+	timeout time.Duration
+}
+
+// NewFileLock creates a lock on path. A timeout of zero waits until the
+// context is cancelled. Taking the lock fails with ErrLockUnsupported on
+// platforms without flock or LockFileEx.
+func NewFileLock(path string, timeout time.Duration) *FileLock {
+	return &FileLock{
+		path:    path,
+		timeout: timeout,
+	}
+}
+
+// Lock takes the lock exclusively and returns the function that releases it
+func (l *FileLock) Lock(ctx context.Context) (func() error, error) {
+	return l.acquire(ctx, true)
+}
+
+// RLock takes the lock shared and returns the function that releases it
+func (l *FileLock) RLock(ctx context.Context) (func() error, error) {
+	return l.acquire(ctx, false)
+}
+
+func (l *FileLock) acquire(ctx context.Context, exclusive bool) (func() error, error) {
+	if l.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, l.timeout)
+		defer cancel()
+	}
+
+	file, err := os.OpenFile(l.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	ticker := time.NewTicker(lockRetryInterval)
+	defer ticker.Stop()
+
+	for {
+		locked, err := tryLock(file, exclusive)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		if locked {
+			return func() error {
+				unlock(file)
+				return file.Close()
+			}, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			file.Close()
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return nil, ErrLockTimeout
+			}
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
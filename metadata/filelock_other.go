@@ -0,0 +1,18 @@
+//go:build !(linux || darwin || freebsd || netbsd || openbsd || dragonfly || windows)
+
+package metadata
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// Platforms without flock or LockFileEx cannot share a lock between
+// processes, so taking one fails instead of silently not locking
+
+func tryLock(file *os.File, exclusive bool) (bool, error) {
+	return false, fmt.Errorf("%w on %s", ErrLockUnsupported, runtime.GOOS)
+}
+
+func unlock(file *os.File) {}
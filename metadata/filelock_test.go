@@ -0,0 +1,180 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package metadata
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// The tests start the test binary again as a second process, which runs
+// TestHelperProcess with the mode in helperEnv
+const (
+	helperEnv     = "METADATA_LOCK_HELPER"
+	helperPathEnv = "METADATA_LOCK_HELPER_PATH"
+	helperNEnv    = "METADATA_LOCK_HELPER_N"
+)
+
+type counter struct {
+	N int `json:"n"`
+}
+
+func helperCommand(t *testing.T, mode, path string, n int) *exec.Cmd {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHelperProcess$")
+	cmd.Env = append(os.Environ(),
+		helperEnv+"="+mode,
+		helperPathEnv+"="+path,
+		helperNEnv+"="+strconv.Itoa(n),
+	)
+	cmd.Stderr = os.Stderr
+	return cmd
+}
+
+func TestHelperProcess(t *testing.T) {
+	mode := os.Getenv(helperEnv)
+	if mode == "" {
+		return
+	}
+	path := os.Getenv(helperPathEnv)
+	n, _ := strconv.Atoi(os.Getenv(helperNEnv))
+
+	switch mode {
+	case "increment":
+		if err := increment(path, n); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	case "hold":
+		// Hold the lock until the parent closes stdin
+		release, err := NewFileLock(path, 0).Lock(context.Background())
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Println("locked")
+		io.Copy(io.Discard, os.Stdin)
+		release()
+	}
+	os.Exit(0)
+}
+
+func increment(path string, n int) error {
+	control := NewMetadataControl[counter](path, WithFileLock(0))
+	for range n {
+		err := control.Update(func(c *counter) error {
+			c.N++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestFileLockConcurrentUpdates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "counter.json")
+	const n = 200
+
+	cmd := helperCommand(t, "increment", path, n)
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := increment(path, n); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("second process: %v", err)
+	}
+
+	got, err := NewMetadataControl[counter](path).Read(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.N != 2*n {
+		t.Fatalf("counter is %d, want %d", got.N, 2*n)
+	}
+}
+
+// holdLock makes another process take the lock on path and returns the
+// function that lets it go
+func holdLock(t *testing.T, path string) func() {
+	t.Helper()
+	cmd := helperCommand(t, "hold", path, 0)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if line, err := bufio.NewReader(stdout).ReadString('\n'); err != nil || line != "locked\n" {
+		t.Fatalf("second process did not take the lock: %q, %v", line, err)
+	}
+
+	done := false
+	release := func() {
+		if done {
+			return
+		}
+		done = true
+		stdin.Close()
+		cmd.Wait()
+	}
+	t.Cleanup(release)
+	return release
+}
+
+func TestFileLockTimeout(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "counter.json.lock")
+	release := holdLock(t, path)
+
+	lock := NewFileLock(path, 50*time.Millisecond)
+	if _, err := lock.Lock(context.Background()); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("Lock = %v, want ErrLockTimeout", err)
+	}
+	if _, err := lock.RLock(context.Background()); !errors.Is(err, ErrLockTimeout) {
+		t.Fatalf("RLock = %v, want ErrLockTimeout", err)
+	}
+
+	release()
+	unlock, err := lock.Lock(context.Background())
+	if err != nil {
+		t.Fatalf("Lock after release: %v", err)
+	}
+	unlock()
+}
+
+func TestFileLockContextCancel(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "counter.json")
+	holdLock(t, path+".lock")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	control := NewMetadataControl[counter](path, WithFileLock(0))
+	err := control.UpdateContext(ctx, func(c *counter) error {
+		c.N++
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("UpdateContext = %v, want context.Canceled", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("file written without the lock: %v", err)
+	}
+}
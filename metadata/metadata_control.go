@@ -1,56 +1,125 @@
 package metadata
 
 import (
-	"encoding/json"
+	"bufio"
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 	"sync"
+	"sync/atomic"
 )
 
 type Control[T any] struct {
 	filePath string
 	mutex    sync.RWMutex
+	options  options
+	codec    Codec
+	lock     *FileLock
+
+	// lastWrite lets Watch ignore the changes made by this Control
+	lastWrite atomic.Pointer[FileSignature]
+
+	cache valueCache[T]
 }
 
-func NewMetadataControl[T any](filePath string) *Control[T] {
-	return &Control[T]{
+func NewMetadataControl[T any](filePath string, opts ...Option) *Control[T] {
+	control := &Control[T]{
 		filePath: filePath,
 	}
+	for _, opt := range opts {
+		opt(&control.options)
+	}
+	control.codec = control.options.resolveCodec(filePath)
+	if control.options.fileLock {
+		control.lock = NewFileLock(filePath+".lock", control.options.lockTimeout)
+	}
+	return control
+}
+
+// Codec returns the codec used when writing the file
+func (control *Control[T]) Codec() Codec {
+	return control.codec
 }
 
 func (control *Control[T]) Read(requireExist bool) (*T, error) {
+	return control.ReadContext(context.Background(), requireExist)
+}
+
+func (control *Control[T]) ReadContext(ctx context.Context, requireExist bool) (*T, error) {
+	data, stale, err := control.readLocked(ctx, requireExist)
+	if errors.Is(err, ErrMetadataCorrupted) && control.options.autoRecover {
+		return control.rewrite(ctx)
+	}
+	if err != nil || !stale {
+		return data, err
+	}
+
+	// The file needs rewriting (e.g. an older schema), which needs the write lock
+	return control.rewrite(ctx)
+}
+
+func (control *Control[T]) readLocked(ctx context.Context, requireExist bool) (*T, bool, error) {
 	control.mutex.RLock()
 	defer control.mutex.RUnlock()
 
-	data := new(T)
-	file, err := os.ReadFile(control.filePath)
+	release, err := control.lockFile(ctx, false)
 	if err != nil {
-		if os.IsNotExist(err) && requireExist {
-			return nil, fmt.Errorf("file %s does not exist", control.filePath)
-		}
-		if os.IsNotExist(err) { // If not requiring existence, return empty data
-			return data, nil
-		}
-		return nil, err
+		return nil, false, err
 	}
+	defer release()
 
-	if len(file) == 0 {
-		return data, nil
-	}
+	return control.readCached(requireExist)
+}
 
-	if err := json.Unmarshal(file, data); err != nil {
+// rewrite re-reads the file under the write lock and writes it back in the
+// current format, recovering it first when it is corrupted
+func (control *Control[T]) rewrite(ctx context.Context) (*T, error) {
+	control.mutex.Lock()
+	defer control.mutex.Unlock()
+
+	release, err := control.lockFile(ctx, true)
+	if err != nil {
 		return nil, err
 	}
+	defer release()
 
+	data, stale, err := control.readData(true)
+	if errors.Is(err, ErrMetadataCorrupted) && control.options.autoRecover {
+		data, _, err = control.recoverData()
+		return data, err
+	}
+	if err != nil {
+		return nil, err
+	}
+	if stale {
+		if err := control.writeData(data); err != nil {
+			return nil, err
+		}
+	}
 	return data, nil
 }
 
 func (control *Control[T]) Update(updateFunc func(*T) error) error {
+	return control.UpdateContext(context.Background(), updateFunc)
+}
+
+func (control *Control[T]) UpdateContext(ctx context.Context, updateFunc func(*T) error) error {
 	control.mutex.Lock()
 	defer control.mutex.Unlock()
 
+	release, err := control.lockFile(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer release()
+
 	// Read current data into a pointer
-	data, err := control.readData()
+	data, _, err := control.readCached(false)
+	if errors.Is(err, ErrMetadataCorrupted) && control.options.autoRecover {
+		data, _, err = control.recoverData()
+	}
 	if err != nil {
 		return err
 	}
@@ -64,40 +133,213 @@ func (control *Control[T]) Update(updateFunc func(*T) error) error {
 	return control.writeData(data)
 }
 
-func (control *Control[T]) readData() (*T, error) {
-	data := new(T)
+// readData reads and decodes the file. The returned flag reports whether the
+// file is stored in an outdated format and should be written back.
+func (control *Control[T]) readData(requireExist bool) (*T, bool, error) {
 	file, err := os.ReadFile(control.filePath)
 	if err != nil {
-		if os.IsNotExist(err) {
-			return data, nil
+		if os.IsNotExist(err) && requireExist {
+			return nil, false, fmt.Errorf("file %s does not exist", control.filePath)
+		}
+		if os.IsNotExist(err) { // If not requiring existence, return empty data
+			return new(T), false, nil
+		}
+		return nil, false, err
+	}
+	return control.decode(file)
+}
+
+// open splits the file into its envelope, the codec it was written with and
+// the decrypted payload
+func (control *Control[T]) open(file []byte) (*envelope, Codec, []byte, error) {
+	env, payload, err := parseEnvelope(file)
+	if err != nil {
+		return nil, nil, nil, corrupted(control.filePath, err)
+	}
+
+	if env != nil && env.Sum != "" && env.Sum != checksum(payload) {
+		return nil, nil, nil, corrupted(control.filePath, errors.New("checksum mismatch"))
+	}
+
+	codec := control.codec
+	if env != nil {
+		var ok bool
+		if codec, ok = CodecByName(env.Codec); !ok {
+			return nil, nil, nil, fmt.Errorf("unknown codec %q in %s", env.Codec, control.filePath)
 		}
+	}
+
+	if env.encrypted() {
+		if payload, err = decrypt(control.options.keys, env, payload); err != nil {
+			if errors.Is(err, errAuthentication) {
+				return nil, nil, nil, corrupted(control.filePath, err)
+			}
+			return nil, nil, nil, fmt.Errorf("decrypting %s: %w", control.filePath, err)
+		}
+	}
+	return env, codec, payload, nil
+}
+
+func (control *Control[T]) decode(file []byte) (*T, bool, error) {
+	data := new(T)
+
+	env, codec, payload, err := control.open(file)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if len(payload) == 0 {
+		return data, false, nil
+	}
+
+	from := env.schemaVersion()
+	stale, err := control.needsReencrypt(env)
+	if err != nil {
+		return nil, false, err
+	}
+	if control.options.schemaVersion > 0 {
+		if from > control.options.schemaVersion {
+			return nil, false, fmt.Errorf("%s has schema v%d, newer than supported v%d", control.filePath, from, control.options.schemaVersion)
+		}
+		if from < control.options.schemaVersion {
+			if payload, err = control.migratePayload(codec, payload, from); err != nil {
+				return nil, false, err
+			}
+			stale = true
+		}
+	}
+
+	if err := codec.Unmarshal(payload, data); err != nil {
+		return nil, false, corrupted(control.filePath, err)
+	}
+	return data, stale, nil
+}
+
+// needsReencrypt reports whether a file is plain or encrypted with a key
+// other than the current one, so Read should rewrite it
+func (control *Control[T]) needsReencrypt(env *envelope) (bool, error) {
+	if control.options.keys == nil {
+		return false, nil
+	}
+	if !env.encrypted() {
+		return true, nil
+	}
+	current, _, err := control.options.keys.CurrentKey()
+	if err != nil {
+		return false, err
+	}
+	return env.KeyID != current, nil
+}
+
+func (control *Control[T]) encode(data *T) ([]byte, error) {
+	payload, err := control.codec.Marshal(data)
+	if err != nil {
 		return nil, err
 	}
 
-	if len(file) > 0 {
-		if err := json.Unmarshal(file, data); err != nil {
-			return nil, err
+	env := &envelope{
+		Codec:  control.codec.Name(),
+		Schema: control.options.schemaVersion,
+	}
+
+	if control.options.keys != nil {
+		if payload, err = encrypt(control.options.keys, env, payload); err != nil {
+			return nil, fmt.Errorf("encrypting %s: %w", control.filePath, err)
 		}
 	}
-	return data, nil
+	if control.options.checksum {
+		env.Sum = checksum(payload)
+	}
+
+	// JSON without any header fields stays a plain file
+	if env.plain() {
+		return payload, nil
+	}
+	return writeEnvelope(env, payload)
 }
 
 func (control *Control[T]) writeData(data *T) error {
-	jsonData, err := json.MarshalIndent(data, "", "  ")
+	content, err := control.encode(data)
 	if err != nil {
 		return err
 	}
 
+	err = control.replaceFile(func(w io.Writer) error {
+		_, err := w.Write(content)
+		return err
+	})
+	if err == nil && control.options.cache {
+		if written := control.lastWrite.Load(); written != nil {
+			control.cache.put(*written, data)
+		}
+	}
+	return err
+}
+
+// replaceFile writes the new content to the .tmp file, flushes it to disk
+// and moves it over the file, keeping a backup when configured
+func (control *Control[T]) replaceFile(write func(w io.Writer) error) error {
 	tempFile := control.filePath + ".tmp"
-	if err := os.WriteFile(tempFile, jsonData, 0644); err != nil {
+	file, err := os.OpenFile(tempFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
 		return err
 	}
 
-	return os.Rename(tempFile, control.filePath)
+	buffered := bufio.NewWriter(file)
+	err = write(buffered)
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tempFile)
+		return err
+	}
+
+	if err := control.backup(); err != nil {
+		return fmt.Errorf("backing up %s: %w", control.filePath, err)
+	}
+
+	control.cache.invalidate()
+	if err := os.Rename(tempFile, control.filePath); err != nil {
+		return err
+	}
+
+	if sig, err := StatSignature(control.filePath); err == nil {
+		control.lastWrite.Store(&sig)
+	}
+	return nil
 }
 
 func (control *Control[T]) Write(data *T) error {
+	return control.WriteContext(context.Background(), data)
+}
+
+func (control *Control[T]) WriteContext(ctx context.Context, data *T) error {
 	control.mutex.Lock()
 	defer control.mutex.Unlock()
+
+	release, err := control.lockFile(ctx, true)
+	if err != nil {
+		return err
+	}
+	defer release()
+
 	return control.writeData(data)
 }
+
+// lockFile takes the cross-process lock when WithFileLock is enabled
+func (control *Control[T]) lockFile(ctx context.Context, exclusive bool) (func() error, error) {
+	if control.lock == nil {
+		return func() error { return nil }, nil
+	}
+	if exclusive {
+		return control.lock.Lock(ctx)
+	}
+	return control.lock.RLock(ctx)
+}
@@ -0,0 +1,71 @@
+package metadata
+
+import "time"
+
+// Option configures a Control
+type Option func(*options)
+
+type options struct {
+	codec       Codec
+	fileLock    bool
+	lockTimeout time.Duration
+
+	schemaVersion     int
+	migrations        map[int]Migration
+	elementMigrations bool
+	elementField      string // migrate this field of each element
+
+	pollInterval time.Duration
+
+	backups        int
+	snapshots      bool
+	snapshotKeep   int
+	snapshotMaxAge time.Duration
+
+	keys KeyProvider
+
+	checksum    bool
+	autoRecover bool
+
+	cache bool
+}
+
+// WithCodec selects the codec used to write the file. Files that already
+// carry a header are always read with the codec named in the header.
+func WithCodec(codec Codec) Option {
+	return func(o *options) {
+		o.codec = codec
+	}
+}
+
+// WithFileLock guards every Read, Update and Write with an advisory lock on
+// <file>.lock so several processes can share the file. Reads take the lock
+// shared, writes exclusive. A timeout of zero waits until the context is done.
+// On platforms without file locks every access fails with ErrLockUnsupported.
+func WithFileLock(timeout time.Duration) Option {
+	return func(o *options) {
+		o.fileLock = true
+		o.lockTimeout = timeout
+	}
+}
+
+// ResolveCodec returns the codec a Control created with these options would
+// use for filePath: the configured codec, else the one matching the file
+// extension, else JSON.
+func ResolveCodec(filePath string, opts ...Option) Codec {
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o.resolveCodec(filePath)
+}
+
+func (o *options) resolveCodec(filePath string) Codec {
+	if o.codec != nil {
+		return o.codec
+	}
+	if codec, ok := CodecForPath(filePath); ok {
+		return codec
+	}
+	return JSONCodec
+}
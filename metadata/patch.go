@@ -0,0 +1,82 @@
+package metadata
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	jsonpatch "github.com/evanphx/json-patch"
+)
+
+var ErrInvalidPatch = errors.New("invalid patch")
+
+// Patch applies an RFC 6902 JSON Patch (a JSON array of operations) or an
+// RFC 7396 JSON Merge Patch (a JSON object) to the stored document and
+// returns the new value. The patch works on the JSON form of T whatever
+// codec the file uses, and the result must still decode into T.
+func (control *Control[T]) Patch(patch []byte) (*T, error) {
+	return control.PatchContext(context.Background(), patch)
+}
+
+func (control *Control[T]) PatchContext(ctx context.Context, patch []byte) (*T, error) {
+	control.mutex.Lock()
+	defer control.mutex.Unlock()
+
+	release, err := control.lockFile(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	current, _, err := control.readData(false)
+	if err != nil {
+		return nil, err
+	}
+
+	patched, err := ApplyPatch(current, patch)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := control.writeData(patched); err != nil {
+		return nil, err
+	}
+	return patched, nil
+}
+
+// ApplyPatch applies a JSON Patch or JSON Merge Patch to the JSON form of
+// value and decodes the result into a new *T. Fields that T does not have
+// are rejected.
+func ApplyPatch[T any](value *T, patch []byte) (*T, error) {
+	doc, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	switch trimmed := bytes.TrimSpace(patch); {
+	case len(trimmed) > 0 && trimmed[0] == '[':
+		operations, err := jsonpatch.DecodePatch(trimmed)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+		}
+		if doc, err = operations.Apply(doc); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+		}
+	case len(trimmed) > 0 && trimmed[0] == '{':
+		if doc, err = jsonpatch.MergePatch(doc, trimmed); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidPatch, err)
+		}
+	default:
+		return nil, fmt.Errorf("%w: expected a JSON array or object", ErrInvalidPatch)
+	}
+
+	result := new(T)
+	decoder := json.NewDecoder(bytes.NewReader(doc))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(result); err != nil {
+		return nil, fmt.Errorf("%w: result does not decode: %v", ErrInvalidPatch, err)
+	}
+	return result, nil
+}
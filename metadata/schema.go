@@ -0,0 +1,203 @@
+package metadata
+
+import (
+	"context"
+	"fmt"
+	"os"
+)
+
+// Migration upgrades a document from one schema version to the next. The
+// document is the generic form produced by the codec: map[string]any for
+// objects, []any for arrays.
+type Migration func(doc any) (any, error)
+
+// MigrationReport describes what migrating a file did, or would do in dry-run
+type MigrationReport struct {
+	Path        string
+	FromVersion int
+	ToVersion   int
+	Changes     []Change
+	Written     bool
+}
+
+// WithSchemaVersion stores version in the file envelope. Files with an
+// older version are migrated on Read and rewritten atomically.
+func WithSchemaVersion(version int) Option {
+	return func(o *options) {
+		o.schemaVersion = version
+	}
+}
+
+// WithMigration registers the migration from schema version `from` to from+1
+func WithMigration(from int, migration Migration) Option {
+	return func(o *options) {
+		if o.migrations == nil {
+			o.migrations = make(map[int]Migration)
+		}
+		o.migrations[from] = migration
+	}
+}
+
+// WithElementMigrations applies every migration to the elements of a
+// top-level array instead of to the array itself. Collections stored in a
+// single file use it so the same item migrations work for every layout.
+func WithElementMigrations() Option {
+	return func(o *options) {
+		o.elementMigrations = true
+	}
+}
+
+// WithElementFieldMigrations applies every migration to the given field of
+// each element of a top-level array, e.g. the item wrapped in each entry of
+// a trash document
+func WithElementFieldMigrations(field string) Option {
+	return func(o *options) {
+		o.elementMigrations = true
+		o.elementField = field
+	}
+}
+
+// Migrate brings the file up to the configured schema version. With dryRun
+// the file is left untouched and the report only lists what would change.
+func (control *Control[T]) Migrate(ctx context.Context, dryRun bool) (*MigrationReport, error) {
+	control.mutex.Lock()
+	defer control.mutex.Unlock()
+
+	release, err := control.lockFile(ctx, true)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	report := &MigrationReport{
+		Path:      control.filePath,
+		ToVersion: control.options.schemaVersion,
+	}
+
+	file, err := os.ReadFile(control.filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			report.FromVersion = report.ToVersion
+			return report, nil
+		}
+		return nil, err
+	}
+
+	env, codec, payload, err := control.open(file)
+	if err != nil {
+		return nil, err
+	}
+	report.FromVersion = env.schemaVersion()
+	if len(payload) == 0 || report.FromVersion >= report.ToVersion {
+		return report, nil
+	}
+
+	var before any
+	if err := codec.Unmarshal(payload, &before); err != nil {
+		return nil, fmt.Errorf("codec %s cannot decode a generic document: %w", codec.Name(), err)
+	}
+	migrated, err := control.migratePayload(codec, payload, report.FromVersion)
+	if err != nil {
+		return nil, err
+	}
+	var after any
+	if err := codec.Unmarshal(migrated, &after); err != nil {
+		return nil, err
+	}
+	report.Changes = Diff(before, after)
+
+	if dryRun {
+		return report, nil
+	}
+
+	data := new(T)
+	if err := codec.Unmarshal(migrated, data); err != nil {
+		return nil, err
+	}
+	if err := control.writeData(data); err != nil {
+		return nil, err
+	}
+	report.Written = true
+	return report, nil
+}
+
+// migratePayload runs the migrations from schema version `from` up to the
+// configured version and returns the re-encoded payload
+func (control *Control[T]) migratePayload(codec Codec, payload []byte, from int) ([]byte, error) {
+	return control.options.migrate(control.filePath, codec, payload, from)
+}
+
+// SchemaVersion returns the schema version configured in opts, or 0
+func SchemaVersion(opts ...Option) int {
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o.schemaVersion
+}
+
+// MigrateValue runs the migrations configured in opts on one value written
+// with schema version `from`, for values kept outside a Control such as
+// journal records or database values. WithElementMigrations is ignored, a
+// value is always migrated as a whole.
+func MigrateValue(name string, codec Codec, data []byte, from int, opts ...Option) ([]byte, error) {
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	o.elementMigrations, o.elementField = false, ""
+	return o.migrate(name, codec, data, from)
+}
+
+func (o *options) migrate(name string, codec Codec, payload []byte, from int) ([]byte, error) {
+	var doc any
+	if err := codec.Unmarshal(payload, &doc); err != nil {
+		return nil, fmt.Errorf("codec %s cannot decode a generic document: %w", codec.Name(), err)
+	}
+
+	for version := from; version < o.schemaVersion; version++ {
+		migration, ok := o.migrations[version]
+		if !ok {
+			return nil, fmt.Errorf("no migration registered from schema v%d for %s", version, name)
+		}
+
+		var err error
+		if o.elementMigrations {
+			doc, err = migrateElements(doc, o.elementField, migration)
+		} else {
+			doc, err = migration(doc)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("migrating %s from v%d to v%d: %w", name, version, version+1, err)
+		}
+	}
+
+	return codec.Marshal(doc)
+}
+
+func migrateElements(doc any, field string, migration Migration) (any, error) {
+	elements, ok := doc.([]any)
+	if !ok {
+		return migration(doc)
+	}
+	for i, element := range elements {
+		if field != "" {
+			entry, ok := element.(map[string]any)
+			if !ok {
+				return nil, fmt.Errorf("element %d is not an object", i)
+			}
+			migrated, err := migration(entry[field])
+			if err != nil {
+				return nil, err
+			}
+			entry[field] = migrated
+			continue
+		}
+		migrated, err := migration(element)
+		if err != nil {
+			return nil, err
+		}
+		elements[i] = migrated
+	}
+	return elements, nil
+}
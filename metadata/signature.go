@@ -0,0 +1,31 @@
+package metadata
+
+import (
+	"os"
+	"time"
+)
+
+// FileSignature identifies one version of a file on disk. Every write goes
+// through tmp+rename, so a new version normally has a new inode as well.
+type FileSignature struct {
+	ModTime time.Time
+	Size    int64
+	Inode   uint64
+}
+
+// StatSignature returns the signature of the file at path
+func StatSignature(path string) (FileSignature, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return FileSignature{}, err
+	}
+	return FileSignature{
+		ModTime: fi.ModTime(),
+		Size:    fi.Size(),
+		Inode:   inode(fi),
+	}, nil
+}
+
+func (s FileSignature) Equal(other FileSignature) bool {
+	return s.ModTime.Equal(other.ModTime) && s.Size == other.Size && s.Inode == other.Inode
+}
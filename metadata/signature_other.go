@@ -0,0 +1,9 @@
+//go:build !unix
+
+package metadata
+
+import "os"
+
+func inode(fi os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,307 @@
+package metadata
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"os"
+)
+
+// errStopIteration ends Each early when the consumer of Elements stops
+var errStopIteration = errors.New("stop iteration")
+
+// Elements streams the elements of an array document one at a time with a
+// json.Decoder instead of decoding the whole slice. Files that cannot be
+// streamed (other codecs, encrypted or outdated schema) are decoded in full.
+// The read lock is held while iterating, so do not write through the same
+// Control inside the loop.
+func Elements[E any](control *Control[[]E]) iter.Seq2[E, error] {
+	return func(yield func(E, error) bool) {
+		err := Each(control, func(element E) error {
+			if !yield(element, nil) {
+				return errStopIteration
+			}
+			return nil
+		})
+		if err != nil && !errors.Is(err, errStopIteration) {
+			var zero E
+			yield(zero, err)
+		}
+	}
+}
+
+// Each calls fn for every element of an array document, see Elements.
+// Returning an error from fn stops the iteration and returns that error.
+func Each[E any](control *Control[[]E], fn func(E) error) error {
+	control.mutex.RLock()
+	defer control.mutex.RUnlock()
+
+	release, err := control.lockFile(context.Background(), false)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return eachElement(control, fn)
+}
+
+// WriteElements replaces an array document with the given elements,
+// encoding them one by one into the file
+func WriteElements[E any](control *Control[[]E], elements iter.Seq[E]) error {
+	control.mutex.Lock()
+	defer control.mutex.Unlock()
+
+	release, err := control.lockFile(context.Background(), true)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return writeElements(control, func(emit func(E) error) error {
+		for element := range elements {
+			if err := emit(element); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// RewriteElements streams every element through fn and writes the result
+// back in a single pass. fn returns the new element and whether to keep it.
+func RewriteElements[E any](control *Control[[]E], fn func(E) (E, bool, error)) error {
+	return RewriteAndAppendElements(control, fn, nil)
+}
+
+// RewriteAndAppendElements is RewriteElements followed by the elements tail
+// returns. tail runs once every element went through fn, so it can append
+// what fn did not find. An error from fn or tail leaves the file unchanged.
+func RewriteAndAppendElements[E any](control *Control[[]E], fn func(E) (E, bool, error), tail func() ([]E, error)) error {
+	control.mutex.Lock()
+	defer control.mutex.Unlock()
+
+	release, err := control.lockFile(context.Background(), true)
+	if err != nil {
+		return err
+	}
+	defer release()
+
+	return writeElements(control, func(emit func(E) error) error {
+		err := eachElement(control, func(element E) error {
+			updated, keep, err := fn(element)
+			if err != nil || !keep {
+				return err
+			}
+			return emit(updated)
+		})
+		if err != nil || tail == nil {
+			return err
+		}
+		appended, err := tail()
+		if err != nil {
+			return err
+		}
+		for _, element := range appended {
+			if err := emit(element); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// streamable reports whether a file with this envelope holds plain JSON
+// that can be decoded element by element
+func (control *Control[T]) streamable(env *envelope) bool {
+	codec := control.codec.Name()
+	if env != nil {
+		codec = env.Codec
+	}
+	if codec != JSONCodec.Name() || env.encrypted() {
+		return false
+	}
+	return control.options.schemaVersion == 0 || env.schemaVersion() >= control.options.schemaVersion
+}
+
+func eachElement[E any](control *Control[[]E], fn func(E) error) error {
+	file, err := os.Open(control.filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	env, decoder, err := readEnvelopeHeader(reader)
+	if err != nil {
+		return corrupted(control.filePath, err)
+	}
+
+	// The checksum of a JSON envelope covers only its data, which cannot be
+	// teed off the decoder
+	wrapped := decoder != nil
+	if !control.streamable(env) || (wrapped && env.Sum != "") {
+		data, _, err := control.readData(false)
+		if err != nil {
+			return err
+		}
+		for _, element := range *data {
+			if err := fn(element); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var payload io.Reader = reader
+	hash := sha256.New()
+	if env != nil && env.Sum != "" {
+		payload = io.TeeReader(reader, hash)
+	}
+
+	if !wrapped {
+		decoder = json.NewDecoder(payload)
+	}
+	token, err := decoder.Token()
+	if err == io.EOF || (err == nil && token == nil) {
+		return nil // empty file or null
+	}
+	if err != nil {
+		return corrupted(control.filePath, err)
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return corrupted(control.filePath, fmt.Errorf("expected a JSON array, got %v", token))
+	}
+
+	for decoder.More() {
+		var element E
+		if err := decoder.Decode(&element); err != nil {
+			return corrupted(control.filePath, err)
+		}
+		if err := fn(element); err != nil {
+			return err
+		}
+	}
+	if _, err := decoder.Token(); err != nil {
+		return corrupted(control.filePath, err)
+	}
+	if wrapped {
+		if token, err := decoder.Token(); err != nil || token != json.Delim('}') {
+			return corrupted(control.filePath, fmt.Errorf("metadata envelope is not closed"))
+		}
+	}
+
+	if !wrapped && env != nil && env.Sum != "" {
+		if _, err := io.Copy(io.Discard, payload); err != nil {
+			return err
+		}
+		if env.Sum != formatChecksum(hash.Sum(nil)) {
+			return corrupted(control.filePath, errors.New("checksum mismatch"))
+		}
+	}
+	return nil
+}
+
+// writeElements writes the elements produced by produce as an indented JSON
+// array. Configurations that need the whole payload up front (other codecs,
+// encryption, checksums) collect the elements and write them in one go.
+func writeElements[E any](control *Control[[]E], produce func(emit func(E) error) error) error {
+	if control.codec != JSONCodec || control.options.keys != nil || control.options.checksum {
+		var elements []E
+		if err := produce(func(element E) error {
+			elements = append(elements, element)
+			return nil
+		}); err != nil {
+			return err
+		}
+		return control.writeData(&elements)
+	}
+
+	return control.replaceFile(func(w io.Writer) error {
+		var closing []byte
+		if control.options.schemaVersion > 0 {
+			header, err := json.Marshal(&envelope{Codec: JSONCodec.Name(), Schema: control.options.schemaVersion})
+			if err != nil {
+				return err
+			}
+			var open []byte
+			open, closing = jsonEnvelopeParts(header)
+			if _, err := w.Write(open); err != nil {
+				return err
+			}
+		}
+
+		count := 0
+		if _, err := io.WriteString(w, "["); err != nil {
+			return err
+		}
+		err := produce(func(element E) error {
+			data, err := json.MarshalIndent(element, "  ", "  ")
+			if err != nil {
+				return err
+			}
+			separator := "\n  "
+			if count > 0 {
+				separator = ",\n  "
+			}
+			count++
+			if _, err := io.WriteString(w, separator); err != nil {
+				return err
+			}
+			_, err = w.Write(data)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+		end := "\n]"
+		if count == 0 {
+			end = "]"
+		}
+		if _, err := io.WriteString(w, end); err != nil {
+			return err
+		}
+		_, err = w.Write(closing)
+		return err
+	})
+}
+
+// readEnvelopeHeader consumes the envelope in front of the payload if the
+// file has one. For a JSON envelope it returns the decoder that read it,
+// positioned at the data.
+func readEnvelopeHeader(reader *bufio.Reader) (*envelope, *json.Decoder, error) {
+	if prefix, _ := reader.Peek(len(jsonEnvelopePrefix)); bytes.Equal(prefix, []byte(jsonEnvelopePrefix)) {
+		decoder := json.NewDecoder(reader)
+		// The prefix guarantees the opening brace and the $metadata key
+		decoder.Token()
+		decoder.Token()
+		env := &envelope{}
+		if err := decoder.Decode(env); err != nil {
+			return nil, nil, fmt.Errorf("invalid metadata envelope: %w", err)
+		}
+		if key, err := decoder.Token(); err != nil || key != "data" {
+			return nil, nil, fmt.Errorf("metadata envelope has no data")
+		}
+		return env, decoder, nil
+	}
+
+	prefix, err := reader.Peek(len(envelopeMagic))
+	if err != nil || !bytes.Equal(prefix, []byte(envelopeMagic)) {
+		return nil, nil, nil
+	}
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		return nil, nil, err
+	}
+	env, _, err := parseEnvelope(line)
+	return env, nil, err
+}
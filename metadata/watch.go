@@ -0,0 +1,173 @@
+package metadata
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// DefaultPollInterval is used when inotify is not available
+var DefaultPollInterval = 2 * time.Second
+
+// watchDebounce collapses the burst of events a single tmp+rename produces
+const watchDebounce = 50 * time.Millisecond
+
+// WithPolling makes Watch poll the file every interval instead of using
+// inotify, e.g. on network filesystems that do not deliver events
+func WithPolling(interval time.Duration) Option {
+	return func(o *options) {
+		o.pollInterval = interval
+	}
+}
+
+// Watch calls onChange with the freshly decoded value whenever another
+// writer changes the file. Changes made through this Control are not
+// reported. Watching stops when ctx is done.
+func (control *Control[T]) Watch(ctx context.Context, onChange func(data *T, err error)) error {
+	dir, base := filepath.Split(control.filePath)
+	if dir == "" {
+		dir = "."
+	}
+
+	var last FileSignature
+	if sig, err := StatSignature(control.filePath); err == nil {
+		last = sig
+	}
+
+	match := func(name string) bool { return name == base }
+	return WatchFiles(ctx, dir, match, control.options.pollInterval, func(string) {
+		sig, err := StatSignature(control.filePath)
+		if err != nil && !os.IsNotExist(err) {
+			onChange(nil, err)
+			return
+		}
+		if sig.Equal(last) || control.ownWrite(sig) {
+			last = sig
+			return
+		}
+		last = sig
+		onChange(control.ReadContext(ctx, false))
+	})
+}
+
+// ownWrite reports whether sig is the file as this Control last wrote it
+func (control *Control[T]) ownWrite(sig FileSignature) bool {
+	written := control.lastWrite.Load()
+	return written != nil && written.Equal(sig)
+}
+
+// WatchFiles calls onChange with the name of every file in dir accepted by
+// match that is created, changed or removed. It uses inotify where possible
+// and falls back to polling every pollInterval (DefaultPollInterval when
+// zero). A positive pollInterval always polls. Watching stops when ctx is done.
+func WatchFiles(ctx context.Context, dir string, match func(name string) bool, pollInterval time.Duration, onChange func(name string)) error {
+	if pollInterval <= 0 {
+		watcher, err := fsnotify.NewWatcher()
+		if err == nil {
+			if err = watcher.Add(dir); err == nil {
+				go notifyLoop(ctx, watcher, match, onChange)
+				return nil
+			}
+			watcher.Close()
+		}
+		if _, statErr := os.Stat(dir); statErr != nil {
+			return statErr
+		}
+		pollInterval = DefaultPollInterval
+	}
+
+	snapshot, err := scanDir(dir, match)
+	if err != nil {
+		return err
+	}
+	go pollLoop(ctx, dir, match, pollInterval, snapshot, onChange)
+	return nil
+}
+
+func notifyLoop(ctx context.Context, watcher *fsnotify.Watcher, match func(string) bool, onChange func(string)) {
+	defer watcher.Close()
+
+	pending := make(map[string]bool)
+	var flush <-chan time.Time
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return
+			}
+			name := filepath.Base(event.Name)
+			if !match(name) {
+				continue
+			}
+			pending[name] = true
+			if flush == nil {
+				flush = time.After(watchDebounce)
+			}
+		case _, ok := <-watcher.Errors:
+			if !ok {
+				return
+			}
+		case <-flush:
+			for name := range pending {
+				onChange(name)
+			}
+			pending = make(map[string]bool)
+			flush = nil
+		}
+	}
+}
+
+func pollLoop(ctx context.Context, dir string, match func(string) bool, interval time.Duration, snapshot map[string]FileSignature, onChange func(string)) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		current, err := scanDir(dir, match)
+		if err != nil {
+			continue
+		}
+		for name, sig := range current {
+			if old, ok := snapshot[name]; !ok || !old.Equal(sig) {
+				onChange(name)
+			}
+		}
+		for name := range snapshot {
+			if _, ok := current[name]; !ok {
+				onChange(name)
+			}
+		}
+		snapshot = current
+	}
+}
+
+func scanDir(dir string, match func(string) bool) (map[string]FileSignature, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]FileSignature)
+	for _, entry := range entries {
+		if entry.IsDir() || !match(entry.Name()) {
+			continue
+		}
+		sig, err := StatSignature(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			continue
+		}
+		result[entry.Name()] = sig
+	}
+	return result, nil
+}
@@ -2,6 +2,7 @@ package plistcontrol
 
 import (
 	"bytes"
+	"context"
 	"encoding/xml"
 	"fmt"
 	"io/ioutil"
@@ -10,23 +11,69 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
+
+	"github.com/mahdi-cpp/api-go-pkg/metadata"
 )
 
 type Control[T any] struct {
 	filePath string
 	mutex    sync.RWMutex
+	lock     *metadata.FileLock
+}
+
+// Option configures a plist Control
+type Option func(*options)
+
+type options struct {
+	fileLock    bool
+	lockTimeout time.Duration
+}
+
+// WithFileLock guards Read, Update and Write with an advisory lock on <file>.lock,
+// the same lock metadata.Control uses, so several processes can share the file
+func WithFileLock(timeout time.Duration) Option {
+	return func(o *options) {
+		o.fileLock = true
+		o.lockTimeout = timeout
+	}
 }
 
-func NewPlistControl[T any](filePath string) *Control[T] {
-	return &Control[T]{
+func NewPlistControl[T any](filePath string, opts ...Option) *Control[T] {
+	o := options{}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	c := &Control[T]{
 		filePath: filePath,
 	}
+	if o.fileLock {
+		c.lock = metadata.NewFileLock(filePath+".lock", o.lockTimeout)
+	}
+	return c
 }
 
 func (c *Control[T]) Read() (*T, error) {
+	return c.ReadContext(context.Background())
+}
+
+func (c *Control[T]) ReadContext(ctx context.Context) (*T, error) {
 	c.mutex.RLock()
 	defer c.mutex.RUnlock()
 
+	if c.lock != nil {
+		release, err := c.lock.RLock(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
+
+	return c.readFile()
+}
+
+func (c *Control[T]) readFile() (*T, error) {
 	data := new(T)
 	content, err := ioutil.ReadFile(c.filePath)
 	if err != nil {
@@ -41,10 +88,14 @@ func (c *Control[T]) Read() (*T, error) {
 	}
 
 	// Create a wrapper type that matches PLIST structure
+	// innerxml only decodes into a string, not into PlistEntry.Value
 	wrapper := struct {
 		XMLName xml.Name `xml:"plist"`
 		Dict    struct {
-			Entries []PlistEntry `xml:",any"`
+			Entries []struct {
+				XMLName xml.Name
+				Value   string `xml:",innerxml"`
+			} `xml:",any"`
 		} `xml:"dict"`
 	}{}
 
@@ -55,7 +106,8 @@ func (c *Control[T]) Read() (*T, error) {
 	// Convert entries to map with proper type assertions
 	plistMap := make(map[string]interface{})
 	key := ""
-	for _, entry := range wrapper.Dict.Entries {
+	for _, raw := range wrapper.Dict.Entries {
+		entry := PlistEntry{XMLName: raw.XMLName, Value: raw.Value}
 		if entry.XMLName.Local == "key" {
 			if str, ok := entry.Value.(string); ok {
 				key = str
@@ -106,9 +158,53 @@ func parsePlistValue(entry PlistEntry) interface{} {
 }
 
 func (c *Control[T]) Write(data *T) error {
+	return c.WriteContext(context.Background(), data)
+}
+
+func (c *Control[T]) WriteContext(ctx context.Context, data *T) error {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 
+	if c.lock != nil {
+		release, err := c.lock.Lock(ctx)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+
+	return c.writeFile(data)
+}
+
+// Update reads the file, applies updateFunc and writes the result while
+// holding the exclusive lock, so changes from other processes are not lost
+func (c *Control[T]) Update(updateFunc func(*T) error) error {
+	return c.UpdateContext(context.Background(), updateFunc)
+}
+
+func (c *Control[T]) UpdateContext(ctx context.Context, updateFunc func(*T) error) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.lock != nil {
+		release, err := c.lock.Lock(ctx)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+
+	data, err := c.readFile()
+	if err != nil {
+		return err
+	}
+	if err := updateFunc(data); err != nil {
+		return err
+	}
+	return c.writeFile(data)
+}
+
+func (c *Control[T]) writeFile(data *T) error {
 	// Convert struct to map
 	plistMap, err := structToMap(data)
 	if err != nil {
@@ -0,0 +1,76 @@
+//go:build linux || darwin || freebsd || netbsd || openbsd || dragonfly
+
+package plistcontrol
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+// TestUpdateConcurrentProcesses starts the test binary again as a second
+// writer, which runs TestHelperProcess with the path in helperEnv
+const (
+	helperEnv  = "PLISTCONTROL_HELPER_PATH"
+	helperNEnv = "PLISTCONTROL_HELPER_N"
+)
+
+type counter struct {
+	N int `plist:"n"`
+}
+
+func TestHelperProcess(t *testing.T) {
+	path := os.Getenv(helperEnv)
+	if path == "" {
+		return
+	}
+	n, _ := strconv.Atoi(os.Getenv(helperNEnv))
+	if err := increment(path, n); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func increment(path string, n int) error {
+	control := NewPlistControl[counter](path, WithFileLock(0))
+	for range n {
+		err := control.Update(func(c *counter) error {
+			c.N++
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestUpdateConcurrentProcesses(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "Info.plist")
+	const n = 200
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestHelperProcess$")
+	cmd.Env = append(os.Environ(), helperEnv+"="+path, helperNEnv+"="+strconv.Itoa(n))
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if err := increment(path, n); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("second process: %v", err)
+	}
+
+	got, err := NewPlistControl[counter](path).Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.N != 2*n {
+		t.Fatalf("counter is %d, want %d", got.N, 2*n)
+	}
+}
@@ -10,6 +10,8 @@ func (a *Album) SetModificationDate(t time.Time) { a.ModificationDate = t }
 func (a *Album) GetID() int                      { return a.ID }
 func (a *Album) GetCreationDate() time.Time      { return a.CreationDate }
 func (a *Album) GetModificationDate() time.Time  { return a.ModificationDate }
+func (a *Album) GetVersion() int64               { return a.Version }
+func (a *Album) SetVersion(v int64)              { a.Version = v }
 
 type Album struct {
 	ID               int       `json:"id"`
@@ -21,6 +23,7 @@ type Album struct {
 	IsHidden         bool      `json:"isHidden"`
 	CreationDate     time.Time `json:"creationDate"`
 	ModificationDate time.Time `json:"modificationDate"`
+	Version          int64     `json:"version"`
 }
 
 type AlbumHandler struct {
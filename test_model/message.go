@@ -8,6 +8,8 @@ func (a *Message) SetModificationDate(t time.Time) { a.ModificationDate = t }
 func (a *Message) GetID() int                      { return a.ID }
 func (a *Message) GetCreationDate() time.Time      { return a.CreationDate }
 func (a *Message) GetModificationDate() time.Time  { return a.ModificationDate }
+func (a *Message) GetVersion() int64               { return a.Version }
+func (a *Message) SetVersion(v int64)              { a.Version = v }
 
 type Message struct {
 	ID      int    `json:"id"`
@@ -22,6 +24,7 @@ type Message struct {
 	ExpiryDate       time.Time `json:"expiryDate"`
 	CreationDate     time.Time `json:"creationDate"`
 	ModificationDate time.Time `json:"modificationDate"`
+	Version          int64     `json:"version"`
 }
 
 type MessageAsset struct {
@@ -1,6 +1,10 @@
 package thumbnail
 
-import "errors"
+import (
+	"errors"
+
+	"github.com/mahdi-cpp/api-go-pkg/metadata"
+)
 
 var (
 	ErrUnsupportedFormat = errors.New("unsupported image format")
@@ -13,6 +17,6 @@ var (
 	ErrThumbnailNotFound = errors.New("thumbnail not found")
 	ErrFileTooLarge      = errors.New("file size exceeds limit")
 	ErrInvalidUpdate     = errors.New("invalid asset update")
-	ErrMetadataCorrupted = errors.New("metadata corrupted")
+	ErrMetadataCorrupted = metadata.ErrMetadataCorrupted
 	ErrIndexCorrupted    = errors.New("index corrupted")
 )